@@ -0,0 +1,96 @@
+// Copyright © 2018 PSPDFKit GmbH (https://pspdfkit.com/)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/rancher/dapper/file"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the DAPPER_CACHE volumes",
+	Long: `Manage the named volumes backing the DAPPER_CACHE paths of the build
+container. The volumes are kept between builds, export and import move them
+to another host, e.g. to seed the cache of a CI runner.`,
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the cache volumes of the current project",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		if err := file.CacheList(lookupRuntime(cmd), all, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the cache volumes of the current project",
+	Long: `Remove the cache volumes of the current project, volumes in use by a
+container are kept. With --dry-run the volumes are only listed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		runtime := lookupRuntime(cmd)
+
+		var err error
+		if viper.GetBool("dry-run") {
+			err = file.CacheList(runtime, all, os.Stdout)
+		} else {
+			err = file.CachePrune(runtime, all, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var cacheExportCmd = &cobra.Command{
+	Use:   "export FILE",
+	Short: "Write the cache volumes to a gzipped tar archive",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := lookup(cmd).CacheExport(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var cacheImportCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Restore the cache volumes from an archive written by export",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := lookup(cmd).CacheImport(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	cacheLsCmd.Flags().Bool("all", false, "List the cache volumes of all projects")
+	cachePruneCmd.Flags().Bool("all", false, "Remove the cache volumes of all projects")
+
+	cacheCmd.AddCommand(cacheLsCmd, cachePruneCmd, cacheExportCmd, cacheImportCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,44 @@
+// Copyright © 2018 PSPDFKit GmbH (https://pspdfkit.com/)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/rancher/dapper/file"
+	"github.com/spf13/viper"
+)
+
+// dryRun walks through the same steps as a real invocation of fn and
+// prints the recorded commands instead of running them.
+func dryRun(dapperFile *file.Dapperfile, fn func() error) error {
+	dapperFile.DryRun()
+
+	var err error
+	if dapperFile.PullFrom != "" {
+		err = dapperFile.PullImage()
+	}
+	if err == nil {
+		err = fn()
+	}
+	if err == nil && dapperFile.PushTo != "" {
+		err = dapperFile.PushImage()
+	}
+	if err != nil && err != file.ErrSkipBuild {
+		return err
+	}
+
+	return dapperFile.PrintPlan(os.Stdout, viper.GetString("plan-format"))
+}
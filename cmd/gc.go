@@ -0,0 +1,62 @@
+// Copyright © 2018 PSPDFKit GmbH (https://pspdfkit.com/)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/rancher/dapper/file"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove old images and containers created by dapper",
+	Long: `Remove the images and containers created by dapper which are selected by
+any of the retention policies. Running containers are never removed. With
+--dry-run the selected images and containers are only listed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runtime := lookupRuntime(cmd)
+
+		flags := cmd.Flags()
+		olderThan, _ := flags.GetDuration("older-than")
+		keepLast, _ := flags.GetInt("keep-last")
+		mergedBranches, _ := flags.GetBool("merged-branches")
+		base, _ := flags.GetString("base")
+
+		err := file.GC(runtime, file.GCOptions{
+			OlderThan:      olderThan,
+			KeepLast:       keepLast,
+			MergedBranches: mergedBranches,
+			Base:           base,
+			DryRun:         viper.GetBool("dry-run"),
+		}, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	gcCmd.Flags().Duration("older-than", 0, "Remove images and containers created longer ago, e.g. 168h")
+	gcCmd.Flags().Int("keep-last", 0, "Keep only the newest N images and containers of each project and variant")
+	gcCmd.Flags().Bool("merged-branches", false, "Remove images and containers of branches merged into HEAD of the current project, the default branch is kept")
+	gcCmd.Flags().String("base", "", "Branch --merged-branches compares with instead of HEAD, e.g. main")
+
+	rootCmd.AddCommand(gcCmd)
+}
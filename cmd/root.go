@@ -17,6 +17,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -29,6 +30,8 @@ import (
 var (
 	VERSION string
 	cfgFile string
+	// fileConfig holds the config file only, without the environment.
+	fileConfig = viper.New()
 
 	rootCmd = &cobra.Command{
 		Use:   "dapper",
@@ -44,54 +47,32 @@ var (
 		DAPPER_RUN_ARGS        Args to add to the docker run command when building
 		DAPPER_ENV             Env vars that should be copied into the build
 		DAPPER_VOLUMES         Volumes that should be mounted on docker run`,
+		Args: cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-
-			if viper.GetBool("version") {
-				fmt.Printf("%s version %s\n", cmd.Name(), VERSION)
-				os.Exit(0)
-			}
-			if viper.GetBool("debug") {
-				log.SetLevel(log.DebugLevel)
-			}
-
-			if directory := viper.GetString("directory"); directory != "" {
-				if err := os.Chdir(directory); err != nil {
-					log.Fatalf("Failed to change to directory %s: %v\n", directory, err)
-				}
+			if viper.GetBool("all-variants") || len(viper.GetStringSlice("variants")) > 0 {
+				runVariants(cmd, args)
 			}
 
-			dapperFile, err := file.Lookup(viper.GetString("file"))
-			if err != nil {
-				log.Fatal(err)
-			}
+			dapperFile := lookup(cmd)
 
-			dapperFile.Mode = viper.GetString("mode")
-			dapperFile.Socket = viper.GetBool("socket")
-			dapperFile.NoOut = viper.GetBool("no-out")
-			dapperFile.Quiet = viper.GetBool("quiet")
-			dapperFile.Keep = viper.GetBool("keep")
-			dapperFile.NoContext = viper.GetBool("no-context")
-			dapperFile.MapUser = viper.GetBool("map-user")
-			dapperFile.PushTo = viper.GetString("push-to")
-			dapperFile.PullFrom = viper.GetString("pull-from")
-			dapperFile.Variant = viper.GetString("variant")
-			dapperFile.MountSuffix = viper.GetString("mount-suffix")
-
-			// When using no build context the image does not contain
-			// any data and the current directory has to be mounted
-			// which is "bind" mode.
-			//
-			if dapperFile.NoContext {
-				dapperFile.Mode = "bind"
-			}
-
-			if dapperFile.Variant == "" {
-				log.Debug("variant not specified using argv/env/config-file")
+			if viper.GetBool("dry-run") {
+				fn := func() error { return dapperFile.Run(args) }
+				if len(dapperFile.Platforms) > 0 {
+					fn = func() error {
+						_, err := dapperFile.RunPlatforms(args)
+						return err
+					}
+				}
+				if viper.GetBool("shell") {
+					fn = func() error { return dapperFile.Shell(args) }
+				} else if viper.GetBool("build") {
+					fn = func() error { return dapperFile.Build(args) }
+				}
 
-				if variant := file.ExtractVariantFromFilename(viper.GetString("file")); variant != "" {
-					log.Debugf("variant detected by filename: %s", variant)
-					dapperFile.Variant = variant
+				if err := dryRun(dapperFile, fn); err != nil {
+					log.Fatal(err)
 				}
+				os.Exit(0)
 			}
 
 			if dapperFile.PullFrom != "" {
@@ -102,7 +83,13 @@ var (
 
 			// todo extra cmd
 			if viper.GetBool("shell") {
-				dapperFile.Shell(args)
+				// only returns if the runtime can not replace the
+				// dapper process
+				if err := dapperFile.Shell(args); err != nil {
+					log.Error(err)
+					os.Exit(file.ExtractErrorCode(err))
+				}
+				os.Exit(0)
 			}
 
 			// todo extra cmd
@@ -115,20 +102,194 @@ var (
 				os.Exit(0)
 			}
 
-			if err := dapperFile.Run(args); err != nil {
-				log.Error(err)
-				os.Exit(file.ExtractErrorCode(err))
+			if len(dapperFile.Platforms) > 0 {
+				matrix("PLATFORM", func() ([]file.MatrixResult, error) {
+					return dapperFile.RunPlatforms(args)
+				})
 			}
 
-			if dapperFile.PushTo != "" {
-				if err := dapperFile.PushImage(); err != nil {
-					log.Fatal(err)
-				}
-			}
+			run(dapperFile, func() error {
+				return dapperFile.Run(args)
+			})
 		},
 	}
 )
 
+// lookup handles the global flags and returns the configured Dapperfile.
+func lookup(cmd *cobra.Command) *file.Dapperfile {
+	setup(cmd)
+	return lookupFile(cmd, viper.GetString("file"))
+}
+
+// setup handles the global flags which apply to every command.
+func setup(cmd *cobra.Command) {
+	if viper.GetBool("version") {
+		fmt.Printf("%s version %s\n", cmd.Root().Name(), VERSION)
+		os.Exit(0)
+	}
+	if viper.GetBool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if directory := viper.GetString("directory"); directory != "" {
+		if err := os.Chdir(directory); err != nil {
+			log.Fatalf("Failed to change to directory %s: %v\n", directory, err)
+		}
+	}
+}
+
+// lookupFile returns the Dapperfile name configured by the global flags.
+func lookupFile(cmd *cobra.Command, name string) *file.Dapperfile {
+	dapperFile, err := file.Lookup(name, newRuntime())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dapperFile.Mode = viper.GetString("mode")
+	dapperFile.Socket = viper.GetBool("socket")
+	dapperFile.NoOut = viper.GetBool("no-out")
+	dapperFile.Quiet = viper.GetBool("quiet")
+	dapperFile.Keep = viper.GetBool("keep")
+	dapperFile.NoContext = viper.GetBool("no-context")
+	dapperFile.MapUser = viper.GetBool("map-user")
+	dapperFile.PushTo = viper.GetString("push-to")
+	dapperFile.PullFrom = viper.GetString("pull-from")
+	dapperFile.Variant = viper.GetString("variant")
+	dapperFile.MountSuffix = viper.GetString("mount-suffix")
+	dapperFile.Pull = viper.GetString("pull")
+	dapperFile.Rebuild = viper.GetBool("rebuild")
+	dapperFile.HashFiles = viper.GetStringSlice("hash-files")
+	dapperFile.TagStrategy = viper.GetString("tag-strategy")
+	dapperFile.FixedTag, _ = cmd.Flags().GetString("tag")
+	if fromConfigFile(cmd, "tag") {
+		dapperFile.FixedTag = fileConfig.GetString("tag")
+	}
+	dapperFile.Jobs = viper.GetInt("jobs")
+	dapperFile.GitIgnore = viper.GetBool("gitignore")
+	dapperFile.StopTimeout = viper.GetDuration("stop-timeout")
+	dapperFile.Timeout = viper.GetDuration("timeout")
+	dapperFile.IdleTimeout = viper.GetDuration("idle-timeout")
+	dapperFile.CacheFrom = stringArray(cmd, "cache-from")
+	dapperFile.CacheTo = stringArray(cmd, "cache-to")
+	dapperFile.Secrets = stringArray(cmd, "secret")
+	dapperFile.SSH = stringArray(cmd, "ssh")
+	dapperFile.Platforms = platforms(cmd)
+
+	if dapperFile.Services, err = file.ParseServices(fileConfig.Get("services")); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(dapperFile.Platforms) > 0 && dapperFile.PushTo != "" {
+		log.Fatal("--push-to can not be combined with --platform, push the image of each platform instead")
+	}
+
+	if err := file.ValidateTagStrategy(dapperFile.TagStrategy); err != nil {
+		log.Fatal(err)
+	}
+
+	// When using no build context the image does not contain
+	// any data and the current directory has to be mounted
+	// which is "bind" mode.
+	//
+	if dapperFile.NoContext {
+		dapperFile.Mode = "bind"
+	}
+
+	if dapperFile.Variant == "" {
+		log.Debug("variant not specified using argv/env/config-file")
+
+		if variant := file.ExtractVariantFromFilename(filepath.Base(name)); variant != "" {
+			log.Debugf("variant detected by filename: %s", variant)
+			dapperFile.Variant = variant
+		}
+	}
+
+	return dapperFile
+}
+
+// stringArray returns the values of a repeatable flag whose values contain
+// commas, viper would split them like a StringSlice. Like the other flags
+// it can be set as space separated DAPPER_* variable or in the config.
+func stringArray(cmd *cobra.Command, name string) []string {
+	if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+		values, _ := cmd.Flags().GetStringArray(name)
+		return values
+	}
+	if v, ok := os.LookupEnv("DAPPER_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))); ok {
+		return strings.Fields(v)
+	}
+	if !viper.InConfig(name) {
+		return nil
+	}
+	return viper.GetStringSlice(name)
+}
+
+// fromConfigFile reports whether name is taken from the config file. Some
+// keys are only read from the command line and the config file, their
+// DAPPER_* variables (e.g. DAPPER_OUTPUT) are or could be settings of the
+// build image, which nested dapper runs inherit.
+func fromConfigFile(cmd *cobra.Command, name string) bool {
+	if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+		return false
+	}
+	return fileConfig.IsSet(name)
+}
+
+// platforms returns --platform, which is not read from DAPPER_PLATFORM.
+func platforms(cmd *cobra.Command) []string {
+	if fromConfigFile(cmd, "platform") {
+		return fileConfig.GetStringSlice("platform")
+	}
+	values, _ := cmd.Flags().GetStringSlice("platform")
+	return values
+}
+
+// lookupRuntime returns the container runtime for commands which do not
+// need a Dapperfile.
+func lookupRuntime(cmd *cobra.Command) file.Runtime {
+	setup(cmd)
+	return newRuntime()
+}
+
+// newRuntime returns the container runtime selected by --runtime.
+func newRuntime() file.Runtime {
+	runtime, err := file.NewRuntime(viper.GetString("runtime"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return runtime
+}
+
+// run calls fn and pushes the build image afterwards if requested. It exits
+// with the exit code of the build if fn fails.
+func run(dapperFile *file.Dapperfile, fn func() error) {
+	if err := fn(); err != nil {
+		log.Error(err)
+		os.Exit(file.ExtractErrorCode(err))
+	}
+
+	if dapperFile.PushTo != "" {
+		if err := dapperFile.PushImage(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// matrix runs fn, prints the table of its results and exits with the exit
+// code of the first failed build.
+func matrix(column string, fn func() ([]file.MatrixResult, error)) {
+	results, err := fn()
+	if len(results) > 0 {
+		fmt.Println()
+		file.PrintMatrix(os.Stdout, column, results)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(file.ExtractErrorCode(err))
+	}
+	os.Exit(0)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(version string) {
@@ -150,20 +311,40 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Print debugging")
 	rootCmd.PersistentFlags().StringP("file", "f", "Dockerfile.dapper", "Dockerfile to build from")
-	rootCmd.PersistentFlags().StringP("mode", "m", "auto", "Execution mode for Dapper bind/cp/auto")
+	rootCmd.PersistentFlags().StringP("mode", "m", "auto", "Execution mode for Dapper bind/cp/sync/auto")
+	rootCmd.PersistentFlags().String("runtime", file.DefaultRuntime, "Container runtime to use ("+strings.Join(file.Runtimes(), ", ")+")")
 	rootCmd.PersistentFlags().StringP("directory", "C", ".", "The directory in which to run, --file is relative to this")
 	rootCmd.PersistentFlags().BoolP("shell", "s", false, "Launch a shell")
 	rootCmd.PersistentFlags().BoolP("socket", "k", false, "Bind in the Docker socket")
 	rootCmd.PersistentFlags().Bool("build", false, "Perform a build")
+	rootCmd.PersistentFlags().StringSlice("platform", nil, "Run the command for each platform, e.g. linux/amd64,linux/arm64, outputs go to linux_arm64/...")
+	rootCmd.PersistentFlags().Bool("all-variants", false, "Run the command in the build image of every Dockerfile.<variant>.dapper")
+	rootCmd.PersistentFlags().StringSlice("variants", nil, "Run the command in the build images of these variants, e.g. alpine,ubuntu")
 	rootCmd.PersistentFlags().String("variant", "", "variant, suffix to use to push/pull docker image")
+	rootCmd.PersistentFlags().String("tag-strategy", "branch", "How to tag the build image ("+strings.Join(file.TagStrategies, ", ")+")")
+	rootCmd.PersistentFlags().String("tag", "latest", "Tag of the build image for --tag-strategy fixed")
 	rootCmd.PersistentFlags().String("pull-from", "", "Pulls a build image to the location")
 	rootCmd.PersistentFlags().String("push-to", "", "Publishes a build image to the location")
 	rootCmd.PersistentFlags().String("mount-suffix", "", "bind mount option to increase performance.\nValid options are \"consistent\", \"cached\", \"delegated\" or empty/none (default)")
+	rootCmd.PersistentFlags().String("pull", "always", "Pull policy for base images (always, missing, never)")
+	rootCmd.PersistentFlags().Bool("rebuild", false, "Build the image even if Dockerfile and build args are unchanged")
+	rootCmd.PersistentFlags().StringSlice("hash-files", nil, "Context files (glob patterns) which trigger a rebuild when changed")
+	rootCmd.PersistentFlags().Bool("gitignore", false, "Leave files matching .gitignore out of the build context, like .dapperignore")
+	rootCmd.PersistentFlags().StringArray("cache-from", nil, "BuildKit cache to import, a directory or e.g. type=registry,ref=... (buildx runtime)")
+	rootCmd.PersistentFlags().StringArray("cache-to", nil, "BuildKit cache to export, a directory or e.g. type=registry,ref=... (buildx runtime)")
+	rootCmd.PersistentFlags().StringArray("secret", nil, "BuildKit secret for RUN --mount=type=secret, e.g. id=npmrc,src=.npmrc (buildx runtime)")
+	rootCmd.PersistentFlags().StringArray("ssh", nil, "BuildKit SSH agent socket or keys for RUN --mount=type=ssh, e.g. default (buildx runtime)")
+	rootCmd.PersistentFlags().IntP("jobs", "j", 1, "Number of independent tasks or variants to run in parallel")
 	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "Make Docker build quieter")
+	rootCmd.PersistentFlags().Duration("timeout", 0, "Stop the build container when it runs longer, e.g. 1h (exit code 124)")
+	rootCmd.PersistentFlags().Duration("idle-timeout", 0, "Stop the build container when it writes no output for this long, e.g. 15m (exit code 124)")
+	rootCmd.PersistentFlags().Duration("stop-timeout", file.DefaultStopTimeout, "Time the build container gets to exit on SIGINT/SIGTERM before it is removed")
 	rootCmd.PersistentFlags().Bool("keep", false, "Don't remove the container that was used to build")
 	rootCmd.PersistentFlags().BoolP("no-context", "X", false, "send Dockerfile via stdin to docker build command")
 	rootCmd.PersistentFlags().BoolP("no-out", "O", false, "Do not copy the output back (in --mode cp)")
 	rootCmd.PersistentFlags().BoolP("map-user", "u", false, "Map UID/GID from dapper process to docker run")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Print the commands that would be run without running them")
+	rootCmd.PersistentFlags().String("plan-format", "shell", "Output format of --dry-run (shell, json)")
 	rootCmd.PersistentFlags().Bool("generate-bash-completion", false, "Generates Bash completion script to Stdout")
 	rootCmd.PersistentFlags().BoolP("version", "v", false, "Show version")
 
@@ -210,5 +391,10 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		log.Infof("Using config file: %v", viper.ConfigFileUsed())
+
+		fileConfig.SetConfigFile(viper.ConfigFileUsed())
+		if err := fileConfig.ReadInConfig(); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
@@ -0,0 +1,96 @@
+// Copyright © 2018 PSPDFKit GmbH (https://pspdfkit.com/)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rancher/dapper/file"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	runCmd = &cobra.Command{
+		Use:   "run TASK [ARGS...]",
+		Short: "Run a task and the tasks it depends on",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			pipeline, err := file.Pipeline(loadTasks(), args[0])
+			if err != nil {
+				log.Fatalf("%v, see `dapper tasks`", err)
+			}
+
+			dapperFile := lookup(cmd)
+
+			runPipeline := func() error {
+				results, err := dapperFile.RunPipeline(pipeline, args[1:])
+				if len(results) > 1 && !viper.GetBool("dry-run") {
+					file.PrintSummary(os.Stderr, results)
+				}
+				return err
+			}
+
+			if viper.GetBool("dry-run") {
+				if err := dryRun(dapperFile, runPipeline); err != nil {
+					log.Fatal(err)
+				}
+				os.Exit(0)
+			}
+
+			if dapperFile.PullFrom != "" {
+				if err := dapperFile.PullImage(); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			run(dapperFile, runPipeline)
+		},
+	}
+
+	tasksCmd = &cobra.Command{
+		Use:   "tasks",
+		Short: "List the tasks defined in the dapper config",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "TASK\tCOMMAND\tDEPENDS ON\tDESCRIPTION")
+			for _, task := range file.SortedTasks(loadTasks()) {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", task.Name, strings.Join(task.Command, " "), strings.Join(task.DependsOn, " "), task.Description)
+			}
+			w.Flush()
+		},
+	}
+)
+
+func init() {
+	// everything after the task name is passed to the task
+	runCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(tasksCmd)
+}
+
+func loadTasks() map[string]*file.Task {
+	tasks, err := file.ParseTasks(viper.Get("tasks"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tasks
+}
@@ -0,0 +1,64 @@
+// Copyright © 2018 PSPDFKit GmbH (https://pspdfkit.com/)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/dapper/file"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// runVariants runs the command in the build image of every selected
+// Dockerfile.<variant>.dapper and exits.
+func runVariants(cmd *cobra.Command, args []string) {
+	setup(cmd)
+
+	if viper.GetBool("shell") || viper.GetBool("build") || len(platforms(cmd)) > 0 || viper.GetString("push-to") != "" {
+		log.Fatal("--all-variants and --variants can not be combined with --shell, --build, --platform or --push-to")
+	}
+
+	variants, err := file.VariantFiles(viper.GetString("file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := file.SelectVariants(variants, viper.GetStringSlice("variants"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dapperFiles := []*file.Dapperfile{}
+	for _, f := range files {
+		dapperFile := lookupFile(cmd, f)
+		dapperFile.Variant = file.ExtractVariantFromFilename(filepath.Base(f))
+		dapperFiles = append(dapperFiles, dapperFile)
+	}
+
+	if viper.GetBool("dry-run") {
+		for _, dapperFile := range dapperFiles {
+			if err := dryRun(dapperFile, func() error { return dapperFile.Run(args) }); err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(0)
+	}
+
+	matrix("VARIANT", func() ([]file.MatrixResult, error) {
+		return file.RunVariants(dapperFiles, args, viper.GetInt("jobs"))
+	})
+}
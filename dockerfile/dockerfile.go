@@ -0,0 +1,500 @@
+// Package dockerfile is a small parser for the parts of the Dockerfile
+// syntax dapper needs: instructions with line continuations, comments,
+// parser directives, heredocs, build stages and ARG declarations.
+package dockerfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	directiveRe = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+	heredocRe   = regexp.MustCompile(`<<(-?)(["']?)([a-zA-Z_][a-zA-Z0-9_]*)(["']?)`)
+)
+
+// heredocInstructions are the instructions which accept heredocs.
+var heredocInstructions = map[string]bool{
+	"ADD":  true,
+	"COPY": true,
+	"RUN":  true,
+}
+
+// knownDirectives are the parser directives, other "# key=value" lines at
+// the top of the file are plain comments.
+var knownDirectives = map[string]bool{
+	"syntax": true,
+	"escape": true,
+	"check":  true,
+}
+
+// Instruction is a single instruction, continuation lines are joined.
+type Instruction struct {
+	// Cmd is the upper-cased instruction, e.g. "FROM".
+	Cmd string
+	// Flags are the leading --flag[=value] arguments, e.g. --platform.
+	Flags []string
+	// Args are the remaining whitespace separated arguments.
+	Args []string
+	// Original is the instruction text as written, without continuations.
+	Original string
+	// Heredocs are the here-documents of RUN, COPY and ADD in order.
+	Heredocs []Heredoc
+	// Line is the 1-based line the instruction starts on.
+	Line int
+}
+
+// Heredoc is a here-document such as "<<EOF" following an instruction.
+type Heredoc struct {
+	// Name is the delimiter word, e.g. "EOF".
+	Name string
+	// Content is the text up to the delimiter line, including the final
+	// newline.
+	Content string
+	// Chomp is set for "<<-EOF", leading tabs are stripped from Content.
+	Chomp bool
+}
+
+// Comment is a comment line which is not a parser directive.
+type Comment struct {
+	// Text is the comment without the leading "#" and whitespace.
+	Text string
+	Line int
+}
+
+// Arg is an ARG declaration.
+type Arg struct {
+	Name       string
+	Default    string
+	HasDefault bool
+	// Stage is the index of the stage declaring the arg, -1 for args
+	// declared before the first FROM.
+	Stage int
+	Line  int
+}
+
+// Stage is a build stage started by FROM.
+type Stage struct {
+	Index int
+	// Name is the name given with "FROM image AS name".
+	Name     string
+	Image    string
+	Platform string
+	From     *Instruction
+	// Instructions of the stage, not including From.
+	Instructions []*Instruction
+	// Comments between From and the next FROM.
+	Comments []Comment
+}
+
+// Dockerfile is a parsed Dockerfile.
+type Dockerfile struct {
+	// Directives are the parser directives such as syntax and escape,
+	// keys are lower-case.
+	Directives map[string]string
+	// Escape is the escape and line continuation character.
+	Escape       rune
+	Instructions []*Instruction
+	Comments     []Comment
+	Stages       []*Stage
+	Args         []Arg
+}
+
+// ParseFile parses the Dockerfile at path.
+func ParseFile(path string) (*Dockerfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	df, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return df, nil
+}
+
+// Parse parses a Dockerfile.
+func Parse(r io.Reader) (*Dockerfile, error) {
+	df := &Dockerfile{
+		Directives: map[string]string{},
+		Escape:     '\\',
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNo := 0
+	directives := true
+	var current *Instruction
+	var text []string
+	// heredoc is the instruction whose here-documents are being read, they
+	// are read one after another.
+	var heredoc *Instruction
+	pending := 0
+
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+
+		if heredoc != nil {
+			doc := &heredoc.Heredocs[len(heredoc.Heredocs)-pending]
+			if doc.Chomp {
+				raw = strings.TrimLeft(raw, "\t")
+			}
+			if raw == doc.Name {
+				if pending--; pending == 0 {
+					heredoc = nil
+				}
+				continue
+			}
+			doc.Content += raw + "\n"
+			continue
+		}
+
+		if directives {
+			if m := directiveRe.FindStringSubmatch(line); m != nil && knownDirectives[strings.ToLower(m[1])] {
+				key := strings.ToLower(m[1])
+				if _, ok := df.Directives[key]; ok {
+					return nil, fmt.Errorf("line %d: duplicate parser directive %s", lineNo, key)
+				}
+				df.Directives[key] = m[2]
+				if key == "escape" {
+					if m[2] != "\\" && m[2] != "`" {
+						return nil, fmt.Errorf("line %d: invalid escape character %q", lineNo, m[2])
+					}
+					df.Escape = rune(m[2][0])
+				}
+				continue
+			}
+			directives = false
+		}
+
+		if current == nil {
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "#") {
+				df.addComment(Comment{
+					Text: strings.TrimSpace(strings.TrimPrefix(line, "#")),
+					Line: lineNo,
+				})
+				continue
+			}
+			current = &Instruction{Line: lineNo}
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			// empty and comment lines inside a continuation are dropped
+			continue
+		}
+
+		if strings.HasSuffix(line, string(df.Escape)) {
+			text = append(text, strings.TrimSpace(strings.TrimSuffix(line, string(df.Escape))))
+			continue
+		}
+
+		text = append(text, line)
+		current.Original = strings.Join(text, " ")
+		if err := df.addInstruction(current); err != nil {
+			return nil, err
+		}
+		if pending = len(current.Heredocs); pending > 0 {
+			heredoc = current
+		}
+		current, text = nil, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if heredoc != nil {
+		doc := heredoc.Heredocs[len(heredoc.Heredocs)-pending]
+		return nil, fmt.Errorf("line %d: unterminated heredoc %s", heredoc.Line, doc.Name)
+	}
+
+	// a trailing continuation ends the instruction
+	if current != nil {
+		current.Original = strings.Join(text, " ")
+		if err := df.addInstruction(current); err != nil {
+			return nil, err
+		}
+		if len(current.Heredocs) > 0 {
+			return nil, fmt.Errorf("line %d: unterminated heredoc %s", current.Line, current.Heredocs[0].Name)
+		}
+	}
+
+	return df, nil
+}
+
+func (df *Dockerfile) addComment(c Comment) {
+	df.Comments = append(df.Comments, c)
+	if len(df.Stages) > 0 {
+		stage := df.Stages[len(df.Stages)-1]
+		stage.Comments = append(stage.Comments, c)
+	}
+}
+
+func (df *Dockerfile) addInstruction(inst *Instruction) error {
+	fields := splitFields(inst.Original)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	inst.Cmd = strings.ToUpper(fields[0])
+	fields = fields[1:]
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		inst.Flags = append(inst.Flags, fields[0])
+		fields = fields[1:]
+	}
+	inst.Args = fields
+
+	if heredocInstructions[inst.Cmd] {
+		for _, m := range heredocRe.FindAllStringSubmatch(inst.Original, -1) {
+			if m[2] != m[4] {
+				continue
+			}
+			inst.Heredocs = append(inst.Heredocs, Heredoc{
+				Name:  m[3],
+				Chomp: m[1] == "-",
+			})
+		}
+	}
+
+	df.Instructions = append(df.Instructions, inst)
+
+	switch inst.Cmd {
+	case "FROM":
+		return df.addStage(inst)
+	case "ARG":
+		df.addArgs(inst)
+	}
+
+	if len(df.Stages) > 0 {
+		stage := df.Stages[len(df.Stages)-1]
+		stage.Instructions = append(stage.Instructions, inst)
+	}
+
+	return nil
+}
+
+func (df *Dockerfile) addStage(inst *Instruction) error {
+	stage := &Stage{
+		Index: len(df.Stages),
+		From:  inst,
+	}
+
+	switch {
+	case len(inst.Args) == 1:
+	case len(inst.Args) == 3 && strings.EqualFold(inst.Args[1], "AS"):
+		stage.Name = strings.ToLower(inst.Args[2])
+	default:
+		return fmt.Errorf("line %d: FROM requires an image and optionally \"AS name\"", inst.Line)
+	}
+	stage.Image = inst.Args[0]
+
+	for _, flag := range inst.Flags {
+		if strings.HasPrefix(flag, "--platform=") {
+			stage.Platform = strings.TrimPrefix(flag, "--platform=")
+		}
+	}
+
+	df.Stages = append(df.Stages, stage)
+	return nil
+}
+
+func (df *Dockerfile) addArgs(inst *Instruction) {
+	for _, field := range inst.Args {
+		arg := Arg{
+			Stage: len(df.Stages) - 1,
+			Line:  inst.Line,
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		arg.Name = kv[0]
+		if len(kv) == 2 {
+			arg.Default = unquote(kv[1])
+			arg.HasDefault = true
+		}
+
+		df.Args = append(df.Args, arg)
+	}
+}
+
+// ArgNames returns the names of all declared ARGs in order of their first
+// declaration.
+func (df *Dockerfile) ArgNames() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, arg := range df.Args {
+		if !seen[arg.Name] {
+			seen[arg.Name] = true
+			names = append(names, arg.Name)
+		}
+	}
+	return names
+}
+
+// Stage returns the stage called name.
+func (df *Dockerfile) Stage(name string) *Stage {
+	name = strings.ToLower(name)
+	for _, stage := range df.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// splitFields splits s at whitespace, keeping quoted strings together.
+func splitFields(s string) []string {
+	fields := []string{}
+	field := strings.Builder{}
+	inField := false
+	var quote rune
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+			field.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			inField = true
+			field.WriteRune(r)
+		}
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// BaseImages returns the per-architecture base images of the stage, given
+// as a comment following FROM:
+//
+//	FROM ubuntu:18.04
+//	# FROM arm=armhf/ubuntu:18.04 arm64=arm64v8/ubuntu:18.04 s390x=skip
+//
+// It returns nil if the stage has no such comment.
+func (s *Stage) BaseImages() map[string]string {
+	for _, comment := range s.Comments {
+		fields := strings.Fields(comment.Text)
+		if len(fields) == 0 || fields[0] != "FROM" {
+			continue
+		}
+
+		images := map[string]string{}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			images[kv[0]] = kv[1]
+		}
+		return images
+	}
+	return nil
+}
+
+// ContextSources returns the sources COPY and ADD take from the build
+// context, sources of other stages, URLs and heredocs are left out.
+// Variables in the sources are not expanded.
+func (df *Dockerfile) ContextSources() []string {
+	sources := []string{}
+	for _, inst := range df.Instructions {
+		if inst.Cmd != "COPY" && inst.Cmd != "ADD" || inst.flag("--from") {
+			continue
+		}
+
+		args := inst.Args
+		if s := strings.Join(args, " "); strings.HasPrefix(s, "[") {
+			var list []string
+			if err := json.Unmarshal([]byte(s), &list); err == nil {
+				args = list
+			}
+		}
+		if len(args) < 2 {
+			continue
+		}
+
+		for _, src := range args[:len(args)-1] {
+			if strings.HasPrefix(src, "<<") || strings.Contains(src, "://") || strings.HasPrefix(src, "git@") {
+				continue
+			}
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
+
+// flag reports whether the instruction has the flag name, with or without
+// value.
+func (inst *Instruction) flag(name string) bool {
+	for _, flag := range inst.Flags {
+		if flag == name || strings.HasPrefix(flag, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand replaces $VAR and ${VAR} in s with values, falling back to the
+// defaults of ARGs declared before the first FROM. Like docker it supports
+// ${VAR:-word}, word if VAR is empty, and ${VAR:+word}, word unless VAR is
+// empty.
+func (df *Dockerfile) Expand(s string, values map[string]string) string {
+	return os.Expand(s, func(key string) string {
+		name, op, word := key, "", ""
+		if i := strings.IndexByte(key, ':'); i > 0 && i+1 < len(key) && (key[i+1] == '-' || key[i+1] == '+') {
+			name, op, word = key[:i], key[i:i+2], key[i+2:]
+		}
+
+		value := df.value(name, values)
+		switch {
+		case op == ":-" && value == "":
+			return df.Expand(word, values)
+		case op == ":+" && value != "":
+			return df.Expand(word, values)
+		case op == ":+":
+			return ""
+		}
+		return value
+	})
+}
+
+func (df *Dockerfile) value(name string, values map[string]string) string {
+	if v, ok := values[name]; ok {
+		return v
+	}
+	for _, arg := range df.Args {
+		if arg.Stage < 0 && arg.Name == name {
+			return arg.Default
+		}
+	}
+	return ""
+}
@@ -0,0 +1,242 @@
+package dockerfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, s string) *Dockerfile {
+	t.Helper()
+	df, err := Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return df
+}
+
+func TestContinuations(t *testing.T) {
+	df := parse(t, `FROM golang:1.10
+ARG A=1 \
+    B \
+# a comment inside the continuation
+
+    C="x y"
+RUN apt-get update && \
+    apt-get install -y git
+`)
+
+	if got, want := df.ArgNames(), []string{"A", "B", "C"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ArgNames = %v, want %v", got, want)
+	}
+	if got := df.Args[2].Default; got != "x y" {
+		t.Errorf("C default = %q, want %q", got, "x y")
+	}
+
+	run := df.Instructions[2]
+	if run.Cmd != "RUN" || run.Line != 7 {
+		t.Errorf("instruction = %s on line %d, want RUN on line 7", run.Cmd, run.Line)
+	}
+	if want := "RUN apt-get update && apt-get install -y git"; run.Original != want {
+		t.Errorf("Original = %q, want %q", run.Original, want)
+	}
+}
+
+func TestEscapeDirective(t *testing.T) {
+	df := parse(t, "# syntax=docker/dockerfile:1\n"+
+		"# escape=`\n"+
+		"FROM mcr.microsoft.com/windows/servercore\n"+
+		"ARG DIR=c:\\dapper\\\n"+
+		"RUN dir `\n"+
+		"    c:\\\n")
+
+	if df.Escape != '`' {
+		t.Errorf("Escape = %q, want '`'", df.Escape)
+	}
+	if got := df.Directives["syntax"]; got != "docker/dockerfile:1" {
+		t.Errorf("syntax directive = %q", got)
+	}
+	if got := df.Args[0].Default; got != `c:\dapper\` {
+		t.Errorf("DIR default = %q, want %q", got, `c:\dapper\`)
+	}
+	if got, want := df.Instructions[2].Original, `RUN dir c:\`; got != want {
+		t.Errorf("Original = %q, want %q", got, want)
+	}
+}
+
+func TestDirectivesOnlyAtTop(t *testing.T) {
+	df := parse(t, "FROM alpine\n# escape=`\nRUN true \\\n  && false\n")
+
+	if df.Escape != '\\' {
+		t.Errorf("Escape = %q, want '\\\\'", df.Escape)
+	}
+	if len(df.Directives) != 0 {
+		t.Errorf("Directives = %v, want none", df.Directives)
+	}
+	if len(df.Instructions) != 2 {
+		t.Errorf("got %d instructions, want 2", len(df.Instructions))
+	}
+}
+
+func TestInvalidEscape(t *testing.T) {
+	if _, err := Parse(strings.NewReader("# escape=x\nFROM alpine\n")); err == nil {
+		t.Error("expected an error for an invalid escape character")
+	}
+}
+
+func TestStages(t *testing.T) {
+	df := parse(t, `ARG GO=1.10
+FROM --platform=$BUILDPLATFORM golang:${GO} AS Build
+# FROM arm=arm32v7/golang:1.10 s390x=skip
+ARG TARGETARCH
+RUN go build
+from build as test
+RUN go test
+FROM alpine
+COPY --from=build /go/bin/app /app
+`)
+
+	if len(df.Stages) != 3 {
+		t.Fatalf("got %d stages, want 3", len(df.Stages))
+	}
+
+	build := df.Stage("BUILD")
+	if build == nil || build.Index != 0 {
+		t.Fatalf("Stage(BUILD) = %v", build)
+	}
+	if build.Image != "golang:${GO}" || build.Platform != "$BUILDPLATFORM" {
+		t.Errorf("build stage image %q platform %q", build.Image, build.Platform)
+	}
+	if got := df.Expand(build.Image, nil); got != "golang:1.10" {
+		t.Errorf("Expand = %q, want golang:1.10", got)
+	}
+	if got := df.Expand(build.Image, map[string]string{"GO": "1.11"}); got != "golang:1.11" {
+		t.Errorf("Expand = %q, want golang:1.11", got)
+	}
+	if got, want := build.BaseImages(), map[string]string{"arm": "arm32v7/golang:1.10", "s390x": "skip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BaseImages = %v, want %v", got, want)
+	}
+	if len(build.Instructions) != 2 {
+		t.Errorf("build stage has %d instructions, want 2", len(build.Instructions))
+	}
+
+	if test := df.Stage("test"); test == nil || test.Image != "build" || test.Index != 1 {
+		t.Errorf("Stage(test) = %v", test)
+	}
+	if last := df.Stages[2]; last.Name != "" || last.BaseImages() != nil {
+		t.Errorf("last stage = %v", last)
+	}
+
+	if df.Args[0].Stage != -1 || df.Args[1].Stage != 0 {
+		t.Errorf("arg stages = %d, %d, want -1, 0", df.Args[0].Stage, df.Args[1].Stage)
+	}
+}
+
+func TestInvalidFrom(t *testing.T) {
+	if _, err := Parse(strings.NewReader("FROM alpine AS\n")); err == nil {
+		t.Error("expected an error for FROM without a stage name")
+	}
+}
+
+func TestHeredocs(t *testing.T) {
+	df := parse(t, `# syntax=docker/dockerfile:1.4
+FROM alpine
+RUN <<EOF
+set -e
+# not a comment
+FROM is not an instruction here
+
+EOF
+COPY <<-"A" /a <<B /b
+	a
+	A
+b
+B
+ARG X
+`)
+
+	if err := df.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got, want := len(df.Instructions), 4; got != want {
+		t.Fatalf("got %d instructions, want %d", got, want)
+	}
+
+	run := df.Instructions[1]
+	want := []Heredoc{{Name: "EOF", Content: "set -e\n# not a comment\nFROM is not an instruction here\n\n"}}
+	if !reflect.DeepEqual(run.Heredocs, want) {
+		t.Errorf("RUN heredocs = %#v, want %#v", run.Heredocs, want)
+	}
+
+	cp := df.Instructions[2]
+	want = []Heredoc{{Name: "A", Content: "a\n", Chomp: true}, {Name: "B", Content: "b\n"}}
+	if !reflect.DeepEqual(cp.Heredocs, want) {
+		t.Errorf("COPY heredocs = %#v, want %#v", cp.Heredocs, want)
+	}
+
+	if arg := df.Instructions[3]; arg.Cmd != "ARG" || arg.Line != 14 {
+		t.Errorf("instruction = %s on line %d, want ARG on line 14", arg.Cmd, arg.Line)
+	}
+	if len(df.Stages) != 1 {
+		t.Errorf("got %d stages, want 1", len(df.Stages))
+	}
+}
+
+func TestUnterminatedHeredoc(t *testing.T) {
+	if _, err := Parse(strings.NewReader("FROM alpine\nRUN <<EOF\ntrue\n")); err == nil {
+		t.Error("expected an error for an unterminated heredoc")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	df := parse(t, `RUN true
+FROM alpine AS a
+FROM alpine AS a
+FOO bar
+`)
+
+	err := df.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Validate = %v, want a ValidationError", err)
+	}
+	if len(verr.Problems) != 3 {
+		t.Errorf("problems = %q, want 3", verr.Problems)
+	}
+}
+
+func TestExpandDefaults(t *testing.T) {
+	df := parse(t, "ARG EMPTY=\nARG GO=1.10\nFROM golang:${GO}\n")
+
+	for s, want := range map[string]string{
+		"golang:${GO:-1.9}":      "golang:1.10",
+		"golang:${UNSET:-1.9}":   "golang:1.9",
+		"golang:${EMPTY:-$GO}":   "golang:1.10",
+		"golang${GO:+-alpine}":   "golang-alpine",
+		"golang${EMPTY:+-slim}":  "golang",
+		"golang:${UNSET:-}":      "golang:",
+		"${UNSET:-a}/${GO:-b}:x": "a/1.10:x",
+	} {
+		if got := df.Expand(s, nil); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestContextSources(t *testing.T) {
+	df := parse(t, `FROM golang AS build
+COPY go.mod go.sum /src/
+COPY --chown=1000 ["scripts/a b", "/scripts/"]
+ADD https://example.com/x.tgz /x.tgz
+COPY <<EOF /etc/conf
+x
+EOF
+FROM alpine
+COPY --from=build /go/bin/app /app
+ADD ./dist/*.tar.gz /
+`)
+
+	if got, want := df.ContextSources(), []string{"go.mod", "go.sum", "scripts/a b", "./dist/*.tar.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ContextSources = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+var instructions = map[string]bool{
+	"ADD":         true,
+	"ARG":         true,
+	"CMD":         true,
+	"COPY":        true,
+	"ENTRYPOINT":  true,
+	"ENV":         true,
+	"EXPOSE":      true,
+	"FROM":        true,
+	"HEALTHCHECK": true,
+	"LABEL":       true,
+	"MAINTAINER":  true,
+	"ONBUILD":     true,
+	"RUN":         true,
+	"SHELL":       true,
+	"STOPSIGNAL":  true,
+	"USER":        true,
+	"VOLUME":      true,
+	"WORKDIR":     true,
+}
+
+// ValidationError lists all problems found by Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid Dockerfile: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the structure of the Dockerfile: known instructions, a
+// FROM before anything but ARG and unique stage names.
+func (df *Dockerfile) Validate() error {
+	problems := []string{}
+
+	if len(df.Stages) == 0 {
+		problems = append(problems, "no FROM instruction")
+	}
+
+	stage := -1
+	for _, inst := range df.Instructions {
+		if !instructions[inst.Cmd] {
+			problems = append(problems, fmt.Sprintf("line %d: unknown instruction %s", inst.Line, inst.Cmd))
+			continue
+		}
+
+		if inst.Cmd == "FROM" {
+			stage++
+		} else if stage < 0 && inst.Cmd != "ARG" {
+			problems = append(problems, fmt.Sprintf("line %d: %s before the first FROM", inst.Line, inst.Cmd))
+		}
+	}
+
+	names := map[string]int{}
+	for _, s := range df.Stages {
+		if s.Name == "" {
+			continue
+		}
+		if line, ok := names[s.Name]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: stage name %s already used on line %d", s.From.Line, s.Name, line))
+			continue
+		}
+		names[s.Name] = s.From.Line
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package file
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tarDirectory writes dir as tar stream to w. Entries are named relative to
+// dir and prefixed with prefix, paths excluded by ignore are left out.
+func tarDirectory(w io.Writer, dir, prefix string, ignore *ignoreMatcher) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+		if name == "." {
+			return nil
+		}
+
+		if rel := filepath.ToSlash(rel); ignore.Ignored(rel) {
+			if info.IsDir() && ignore.SkipDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return addTarEntry(tw, p, name, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// tarPath writes the file or directory p as tar stream to w, like
+// `docker cp` the entries are prefixed with the base name of p.
+func tarPath(w io.Writer, p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return tarDirectory(w, abs, filepath.Base(abs), nil)
+	}
+
+	tw := tar.NewWriter(w)
+	if err := addTarEntry(tw, abs, filepath.Base(abs), info); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarContext writes the build context dir as tar stream to w without the
+// paths matching the ignore patterns. Like docker the Dockerfile is always
+// part of the context.
+func tarContext(w io.Writer, dir, dockerfile string, ignore []string) error {
+	m, err := newIgnoreMatcher(ignore)
+	if err != nil {
+		return err
+	}
+	m.keep = append(m.keep, filepath.ToSlash(filepath.Clean(dockerfile)))
+	return tarDirectory(w, dir, "", m)
+}
+
+// tarFile writes a tar stream with a single regular file.
+func tarFile(w io.Writer, name string, content []byte) error {
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func addTarEntry(tw *tar.Writer, p, name string, info os.FileInfo) error {
+	// like docker cp, sockets and named pipes of e.g. running tools are
+	// left out, they can not be copied
+	if info.Mode()&(os.ModeSocket|os.ModeNamedPipe) != 0 {
+		log.Debugf("Skipping %s, it is a socket or named pipe", p)
+		return nil
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// untar extracts the tar stream r into the directory dst.
+func untar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := extractEntry(tr, hdr, dst, hdr.Name); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry writes the current entry of tr to name below dst, entries
+// other than directories, symlinks and regular files are skipped.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dst, name string) error {
+	target := filepath.Join(dst, filepath.FromSlash(name))
+	if target != filepath.Clean(dst) && !strings.HasPrefix(target, filepath.Clean(dst)+string(os.PathSeparator)) {
+		return fmt.Errorf("refusing to extract %s outside of %s", hdr.Name, dst)
+	}
+	if err := checkParents(dst, target); err != nil {
+		return fmt.Errorf("refusing to extract %s: %v", hdr.Name, err)
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, mode|0700)
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// checkParents fails if a parent of target below dst is a symlink, which an
+// earlier entry of the archive could have pointed outside of dst.
+func checkParents(dst, target string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	p := filepath.Clean(dst)
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestTarDirectorySkipsSockets(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	buf := &bytes.Buffer{}
+	if err := tarDirectory(buf, dir, "", nil); err != nil {
+		t.Fatalf("tarDirectory: %v", err)
+	}
+	if names, _ := tarEntries(t, buf); !reflect.DeepEqual(names, []string{"main.go"}) {
+		t.Errorf("entries = %v, want [main.go]", names)
+	}
+}
@@ -0,0 +1,79 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ArtifactsFile is written after DAPPER_OUTPUT was copied back.
+const ArtifactsFile = "dapper-artifacts.json"
+
+// Artifact is a file copied back from the build container.
+type Artifact struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Source      string `json:"source"`
+	ImageDigest string `json:"imageDigest"`
+	Commit      string `json:"commit"`
+}
+
+var (
+	artifactsMu sync.Mutex
+	// artifacts are all artifacts of this process, so runs of several
+	// tasks end up in the same manifest.
+	artifacts = map[string]Artifact{}
+)
+
+// writeArtifacts adds files copied from a container of image to
+// ArtifactsFile.
+func (d *Dapperfile) writeArtifacts(image string, files []CopiedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	digest := ""
+	if info, err := d.runtime.Inspect(image); err == nil {
+		digest = info.ID
+	}
+	commit := d.Commit()
+
+	artifactsMu.Lock()
+	defer artifactsMu.Unlock()
+
+	for _, f := range files {
+		hash, err := fileHash(f.Path)
+		if err != nil {
+			return err
+		}
+
+		artifacts[f.Path] = Artifact{
+			Path:        filepath.ToSlash(f.Path),
+			Size:        f.Size,
+			SHA256:      hash,
+			Source:      f.Source,
+			ImageDigest: digest,
+			Commit:      commit,
+		}
+	}
+
+	list := []Artifact{}
+	for _, a := range artifacts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+
+	content, err := json.MarshalIndent(struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}{list}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ArtifactsFile, append(content, '\n'), 0644)
+}
@@ -0,0 +1,59 @@
+package file
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// buildxCLI builds the build image with BuildKit through `docker buildx
+// build`, everything else is done by the docker CLI.
+type buildxCLI struct {
+	*dockerCLI
+}
+
+func newBuildxCLI() (Runtime, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, err
+	}
+	return &buildxCLI{&dockerCLI{docker: docker}}, nil
+}
+
+func (b *buildxCLI) Name() string {
+	return "buildx"
+}
+
+func (b *buildxCLI) Build(opts BuildOptions) error {
+	return b.build(opts, b.buildArgs(opts))
+}
+
+// buildArgs loads the image into the engine, builders using the
+// docker-container driver keep it in their cache otherwise.
+func (b *buildxCLI) buildArgs(opts BuildOptions) []string {
+	return append([]string{"buildx", "build", "--load"}, b.dockerCLI.buildArgs(opts)[1:]...)
+}
+
+func (b *buildxCLI) Inspect(ref string) (*ImageInfo, error) {
+	// BuildKit leaves .ContainerConfig empty
+	return b.inspect(ref, true)
+}
+
+// buildKit adds the BuildKit options to opts. A cache given as plain
+// directory is a local cache, which works without a registry.
+func (d *Dapperfile) buildKit(opts *BuildOptions) {
+	for _, cache := range d.CacheFrom {
+		opts.CacheFrom = append(opts.CacheFrom, localCache(cache, "src=", ""))
+	}
+	for _, cache := range d.CacheTo {
+		opts.CacheTo = append(opts.CacheTo, localCache(cache, "dest=", ",mode=max"))
+	}
+	opts.Secrets = d.Secrets
+	opts.SSH = d.SSH
+}
+
+func localCache(cache, key, suffix string) string {
+	if strings.Contains(cache, "=") {
+		return cache
+	}
+	return "type=local," + key + cache + suffix
+}
@@ -0,0 +1,263 @@
+package file
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheLabel holds the container path of a DAPPER_CACHE volume.
+const CacheLabel = "dapper.cache"
+
+// cacheDir is where the cache volumes are mounted for export and import.
+const cacheDir = "/dapper-cache"
+
+type cacheVolume struct {
+	Name string
+	Path string
+	// Key names the volume in exports, it does not depend on the project.
+	Key string
+}
+
+// cacheVolumes returns the volumes of the DAPPER_CACHE paths. They are
+// named after the project and, depending on DAPPER_CACHE_SCOPE, the
+// variant and the host architecture.
+func (d *Dapperfile) cacheVolumes() ([]cacheVolume, error) {
+	prefix := []string{"dapper-cache", Project()}
+	for _, scope := range d.env.CacheScope() {
+		switch scope {
+		case "variant":
+			if d.Variant != "" {
+				prefix = append(prefix, d.Variant)
+			}
+		case "arch":
+			prefix = append(prefix, d.hostArch)
+		default:
+			return nil, fmt.Errorf("invalid DAPPER_CACHE_SCOPE %q, valid scopes are: variant, arch", scope)
+		}
+	}
+
+	volumes := []cacheVolume{}
+	for _, p := range d.env.Cache() {
+		key := strings.Trim(re.ReplaceAllLiteralString(p, "-"), "-")
+		name := strings.Join(append(prefix, key), "-")
+		volumes = append(volumes, cacheVolume{
+			Name: re.ReplaceAllLiteralString(name, "-"),
+			Path: p,
+			Key:  key,
+		})
+	}
+	return volumes, nil
+}
+
+// createCacheVolumes creates the labeled DAPPER_CACHE volumes, so they can
+// be listed and pruned later.
+func (d *Dapperfile) createCacheVolumes() error {
+	volumes, err := d.cacheVolumes()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range volumes {
+		labels := d.labels()
+		labels[CacheLabel] = v.Path
+		if err := d.runtime.CreateVolume(v.Name, labels); err != nil {
+			return fmt.Errorf("failed to create cache volume %s: %v", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// cacheResources lists the cache volumes of the current project or, with
+// all, of every project.
+func cacheResources(runtime Runtime, all bool) ([]Resource, error) {
+	resources, err := runtime.List("volume", CacheLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	project := Project()
+	ret := []Resource{}
+	for _, r := range resources {
+		if all || r.Labels[ProjectLabel] == project {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// CacheList writes a table of the cache volumes to w.
+func CacheList(runtime Runtime, all bool, w io.Writer) error {
+	resources, err := cacheResources(runtime, all)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tPROJECT\tPATH\tCREATED")
+	for _, r := range resources {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.ID, r.Labels[ProjectLabel], r.Labels[CacheLabel],
+			r.Created.Local().Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+// CachePrune removes the cache volumes, volumes used by containers are
+// kept.
+func CachePrune(runtime Runtime, all bool, w io.Writer) error {
+	resources, err := cacheResources(runtime, all)
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for _, r := range resources {
+		if err := runtime.RemoveVolume(r.ID); err != nil {
+			log.Errorf("Failed to remove cache volume %s: %v", r.ID, err)
+			failed = err
+			continue
+		}
+		fmt.Fprintln(w, r.ID)
+	}
+	return failed
+}
+
+// cacheContainer creates a container with all cache volumes mounted below
+// cacheDir. It is never started, it is only used to copy from and to the
+// volumes.
+func (d *Dapperfile) cacheContainer() (string, []cacheVolume, error) {
+	image, err := d.build()
+	if err != nil {
+		return "", nil, err
+	}
+
+	volumes, err := d.cacheVolumes()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(volumes) == 0 {
+		return "", nil, fmt.Errorf("DAPPER_CACHE is not set in %s", d.File)
+	}
+
+	if err := d.createCacheVolumes(); err != nil {
+		return "", nil, err
+	}
+
+	opts := RunOptions{
+		Name:   fmt.Sprintf("%s-cache-%s", d.ImageName(), randString()),
+		Image:  image,
+		Labels: d.labels(),
+	}
+	for _, v := range volumes {
+		opts.Volumes = append(opts.Volumes, v.Name+":"+cacheDir+"/"+v.Key)
+	}
+
+	return opts.Name, volumes, d.runtime.Create(opts)
+}
+
+// CacheExport writes the content of the cache volumes as gzipped tar
+// archive to file.
+func (d *Dapperfile) CacheExport(file string) error {
+	container, volumes, err := d.cacheContainer()
+	if container != "" {
+		defer d.runtime.Rm(container)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the volumes are streamed into the archive, so nothing is written to
+	// disk twice
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(d.runtime.CopyFrom(container, cacheDir, pw))
+	}()
+	defer pr.Close()
+
+	gz := gzip.NewWriter(f)
+	if err := rebaseTar(gz, pr, cacheDir); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Exported %d cache volumes to %s", len(volumes), file)
+	return f.Close()
+}
+
+// rebaseTar copies the tar stream of `docker cp` for dir from r to w with
+// the entries relative to dir.
+func rebaseTar(w io.Writer, r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		rel, ok := outputRel(dir, hdr.Name)
+		if !ok || rel == "" {
+			continue
+		}
+		hdr.Name = rel
+		if hdr.Typeflag == tar.TypeLink {
+			if hdr.Linkname, ok = outputRel(dir, hdr.Linkname); !ok {
+				return fmt.Errorf("hard link %s points outside of %s", rel, dir)
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// CacheImport extracts an archive written by CacheExport into the cache
+// volumes, paths missing in DAPPER_CACHE are skipped.
+func (d *Dapperfile) CacheImport(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	container, volumes, err := d.cacheContainer()
+	if container != "" {
+		defer d.runtime.Rm(container)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.runtime.CopyTo(container, cacheDir, gz); err != nil {
+		return err
+	}
+
+	log.Infof("Imported %s into %d cache volumes", file, len(volumes))
+	return nil
+}
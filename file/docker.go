@@ -0,0 +1,467 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerCLI implements Runtime by shelling out to the docker binary.
+type dockerCLI struct {
+	docker string
+}
+
+func newDockerCLI() (Runtime, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, err
+	}
+	return &dockerCLI{docker: docker}, nil
+}
+
+func (c *dockerCLI) Name() string {
+	return "docker"
+}
+
+func (c *dockerCLI) Arch() (string, error) {
+	output, err := c.output("version", "-f", "{{.Server.Arch}}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (c *dockerCLI) Build(opts BuildOptions) error {
+	return c.build(opts, c.buildArgs(opts))
+}
+
+// build runs the build command args with the context of opts.
+func (c *dockerCLI) build(opts BuildOptions, args []string) error {
+	stdin := opts.Stdin
+	if stdin == nil && len(opts.Ignore) > 0 {
+		// the filtered context is sent as tar stream
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(tarContext(pw, buildContext(opts), opts.File, opts.Ignore))
+		}()
+		stdin = pr
+	} else if stdin == nil {
+		stdin = os.Stdin
+	}
+	return c.execWithStreams(stdin, stdout(opts.Stdout), stderr(opts.Stderr), args...)
+}
+
+func (c *dockerCLI) buildArgs(opts BuildOptions) []string {
+	args := []string{"build"}
+
+	if opts.Tag != "" {
+		args = append(args, "-t", opts.Tag)
+	}
+
+	if opts.Quiet {
+		args = append(args, "-q")
+	}
+
+	for _, v := range opts.BuildArgs {
+		args = append(args, "--build-arg", v)
+	}
+
+	for _, k := range sortedKeys(opts.Labels) {
+		args = append(args, "--label", k+"="+opts.Labels[k])
+	}
+
+	if opts.Platform != "" {
+		args = append(args, "--platform", opts.Platform)
+	}
+
+	for _, v := range opts.CacheFrom {
+		args = append(args, "--cache-from", v)
+	}
+
+	for _, v := range opts.CacheTo {
+		args = append(args, "--cache-to", v)
+	}
+
+	for _, v := range opts.Secrets {
+		args = append(args, "--secret", v)
+	}
+
+	for _, v := range opts.SSH {
+		args = append(args, "--ssh", v)
+	}
+
+	args = append(args, opts.Extra...)
+
+	if opts.Pull {
+		args = append(args, "--pull")
+	}
+
+	if opts.Stdin != nil {
+		return append(args, "-")
+	}
+
+	if len(opts.Ignore) > 0 {
+		return append(args, "-f", filepath.ToSlash(opts.File), "-")
+	}
+
+	args = append(args, "-f", opts.File)
+	if opts.Context != "" {
+		args = append(args, opts.Context)
+	}
+
+	return args
+}
+
+func (c *dockerCLI) Run(opts RunOptions) error {
+	if opts.Detach {
+		// the id printed by run -d is not needed, the container has a name
+		_, err := c.output(append([]string{"run"}, c.runArgs(opts)...)...)
+		return withStderr(err)
+	}
+	return c.attach(opts, append([]string{"run"}, c.runArgs(opts)...))
+}
+
+func (c *dockerCLI) Create(opts RunOptions) error {
+	// the id printed by create is not needed, the container has a name
+	_, err := c.output(append([]string{"create"}, c.runArgs(opts)...)...)
+	return withStderr(err)
+}
+
+func (c *dockerCLI) CopyTo(container, dir string, content io.Reader) error {
+	return c.execWithStreams(content, os.Stdout, os.Stderr, "cp", "-", container+":"+dir)
+}
+
+func (c *dockerCLI) Start(opts RunOptions) error {
+	return c.attach(opts, c.startArgs(opts))
+}
+
+func (c *dockerCLI) startArgs(opts RunOptions) []string {
+	args := []string{"start", "-a"}
+	if opts.Interactive {
+		args = append(args, "-i")
+	}
+	return append(args, opts.Name)
+}
+
+// attach runs args with the streams of the container attached to the
+// terminal or to opts.Stdout and opts.Stderr.
+func (c *dockerCLI) attach(opts RunOptions, args []string) error {
+	if opts.Replace {
+		log.Debugf("Exec %s %v", c.docker, args)
+		return syscall.Exec(c.docker, append([]string{filepath.Base(c.docker)}, args...), os.Environ())
+	}
+
+	var stdin io.Reader
+	if opts.Interactive {
+		stdin = os.Stdin
+	}
+	return c.execWithStreams(stdin, stdout(opts.Stdout), stderr(opts.Stderr), args...)
+}
+
+func (c *dockerCLI) runArgs(opts RunOptions) []string {
+	args := []string{}
+
+	if opts.Remove {
+		args = append(args, "--rm")
+	}
+
+	if opts.Detach {
+		args = append(args, "-d")
+	}
+
+	if opts.Interactive {
+		args = append(args, "-i")
+	}
+
+	if opts.Name != "" {
+		args = append(args, "--name", opts.Name)
+	}
+
+	if opts.TTY {
+		args = append(args, "-t")
+	}
+
+	if opts.Platform != "" {
+		args = append(args, "--platform", opts.Platform)
+	}
+
+	if opts.Network != "" {
+		args = append(args, "--network", opts.Network)
+	}
+
+	for _, alias := range opts.NetworkAliases {
+		args = append(args, "--network-alias", alias)
+	}
+
+	if opts.Socket {
+		args = append(args, "-v", fmt.Sprintf("%s:/var/run/docker.sock", hostSocket()))
+	}
+
+	for _, vol := range opts.Volumes {
+		args = append(args, "-v", vol)
+	}
+
+	for _, env := range opts.Env {
+		args = append(args, "-e", env)
+	}
+
+	if opts.Entrypoint != "" {
+		args = append(args, "--entrypoint", opts.Entrypoint)
+	}
+
+	if opts.MapUser {
+		args = append(args, "-u", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+		args = append(args, "-v", "/etc/passwd:/etc/passwd:ro")
+		args = append(args, "-v", "/etc/group:/etc/group:ro")
+	}
+
+	for _, k := range sortedKeys(opts.Labels) {
+		args = append(args, "--label", k+"="+opts.Labels[k])
+	}
+
+	args = append(args, opts.RunArgs...)
+	args = append(args, opts.Image)
+
+	return append(args, opts.Command...)
+}
+
+func (c *dockerCLI) Inspect(ref string) (*ImageInfo, error) {
+	return c.inspect(ref, false)
+}
+
+// inspect reads the image env either from the container config (docker
+// build) or from the image config (podman/buildah and BuildKit). Images
+// with an empty container config, e.g. built by BuildKit through `docker
+// build`, always use the image config.
+func (c *dockerCLI) inspect(ref string, configEnv bool) (*ImageInfo, error) {
+	output, err := exec.Command(c.docker, "image", "inspect", ref).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []struct {
+		ID              string `json:"Id"`
+		Architecture    string
+		ContainerConfig struct {
+			Env []string
+		}
+		Config struct {
+			Env    []string
+			Labels map[string]string
+		}
+	}
+	if err := json.Unmarshal(output, &images); err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no such image: %s", ref)
+	}
+
+	image := images[0]
+	env := image.ContainerConfig.Env
+	if configEnv || len(env) == 0 {
+		env = image.Config.Env
+	}
+
+	return &ImageInfo{
+		ID:           image.ID,
+		Architecture: image.Architecture,
+		Env:          env,
+		Labels:       image.Config.Labels,
+	}, nil
+}
+
+func (c *dockerCLI) Tag(source, target string) error {
+	return c.exec("tag", source, target)
+}
+
+func (c *dockerCLI) Push(ref string) error {
+	return c.exec("push", ref)
+}
+
+func (c *dockerCLI) Pull(ref string) error {
+	return c.exec("pull", ref)
+}
+
+func (c *dockerCLI) Cp(src, dst string) error {
+	return c.exec("cp", src, dst)
+}
+
+func (c *dockerCLI) CopyFrom(container, src string, w io.Writer) error {
+	return c.execWithStreams(nil, w, os.Stderr, "cp", container+":"+src, "-")
+}
+
+func (c *dockerCLI) List(kind, label string) ([]Resource, error) {
+	args := []string{kind, "ls", "-q", "--filter", "label=" + label}
+	switch kind {
+	case "container":
+		args = append(args, "-a", "--no-trunc")
+	case "image":
+		args = append(args, "--no-trunc")
+	}
+
+	output, err := c.output(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// images with several tags are listed once per tag
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, id := range strings.Fields(string(output)) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	output, err = c.output(append([]string{kind, "inspect"}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []struct {
+		ID        string `json:"Id"`
+		Name      string
+		RepoTags  []string
+		Created   time.Time
+		CreatedAt time.Time
+		Labels    map[string]string
+		Config    struct {
+			Labels map[string]string
+		}
+		State struct {
+			Running bool
+		}
+	}
+	if err := json.Unmarshal(output, &items); err != nil {
+		return nil, err
+	}
+
+	resources := []Resource{}
+	for _, item := range items {
+		r := Resource{
+			ID:      item.ID,
+			Names:   item.RepoTags,
+			Labels:  item.Config.Labels,
+			Created: item.Created,
+			Running: item.State.Running,
+		}
+		switch kind {
+		case "container":
+			r.Names = []string{strings.TrimPrefix(item.Name, "/")}
+		case "volume":
+			r.ID = item.Name
+			r.Names = []string{item.Name}
+			r.Labels = item.Labels
+			r.Created = item.CreatedAt
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+func (c *dockerCLI) CreateVolume(name string, labels map[string]string) error {
+	args := []string{"volume", "create"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	_, err := c.output(append(args, name)...)
+	return err
+}
+
+func (c *dockerCLI) RemoveVolume(name string) error {
+	_, err := c.execWithOutput("volume", "rm", name)
+	return err
+}
+
+func (c *dockerCLI) CreateNetwork(name string, labels map[string]string) error {
+	args := []string{"network", "create"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	_, err := c.output(append(args, name)...)
+	return err
+}
+
+func (c *dockerCLI) RemoveNetwork(name string) error {
+	_, err := c.execWithOutput("network", "rm", name)
+	return err
+}
+
+func (c *dockerCLI) Exec(name string, command []string) error {
+	_, err := c.execWithOutput(append([]string{"exec", name}, command...)...)
+	return err
+}
+
+func (c *dockerCLI) RemoveImage(ref string) error {
+	_, err := c.execWithOutput("rmi", ref)
+	return err
+}
+
+func (c *dockerCLI) Kill(name, signal string) error {
+	_, err := c.execWithOutput("kill", "--signal", signal, name)
+	return err
+}
+
+func (c *dockerCLI) Rm(name string) error {
+	_, err := c.execWithOutput("rm", "-fv", name)
+	return err
+}
+
+func (c *dockerCLI) exec(args ...string) error {
+	log.Debugf("Running %s %v", c.docker, args)
+	cmd := exec.Command(c.docker, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	err := cmd.Run()
+	if err != nil {
+		log.Debugf("Failed running %s %v: %v", c.docker, args, err)
+	}
+	return err
+}
+
+func (c *dockerCLI) execWithStreams(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	log.Debugf("Running %s %v", c.docker, args)
+	cmd := exec.Command(c.docker, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Stdin = stdin
+	err := cmd.Run()
+	if err != nil {
+		log.Debugf("Failed running %s %v: %v", c.docker, args, err)
+	}
+	return err
+}
+
+// output runs the command and returns its stdout only.
+func (c *dockerCLI) output(args ...string) ([]byte, error) {
+	return exec.Command(c.docker, args...).Output()
+}
+
+// withStderr adds the stderr captured by output to err.
+func withStderr(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return err
+}
+
+func (c *dockerCLI) execWithOutput(args ...string) ([]byte, error) {
+	cmd := exec.Command(c.docker, args...)
+	return cmd.CombinedOutput()
+}
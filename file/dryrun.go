@@ -0,0 +1,259 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var unsafeShellRe = regexp.MustCompile(`[^\w@%+=:,./-]`)
+
+// PlanStep is a single command dapper would have run.
+type PlanStep struct {
+	Command []string `json:"command"`
+	// Stdin is the file sent to the command on stdin.
+	Stdin string `json:"stdin,omitempty"`
+}
+
+// Plan is the result of a --dry-run.
+type Plan struct {
+	Image     string   `json:"image"`
+	HostArch  string   `json:"hostArch"`
+	Mode      string   `json:"mode"`
+	BuildArgs []string `json:"buildArgs"`
+	// Retargeted are the stages with a replaced base image.
+	Retargeted []Retarget `json:"retargeted,omitempty"`
+	Steps      []PlanStep `json:"steps"`
+}
+
+// dryRun records every operation which would change the state of the
+// engine as command line, only read-only operations reach the runtime.
+type dryRun struct {
+	Runtime
+	cli       *dockerCLI
+	buildArgs func(BuildOptions) []string
+	translate func(RunOptions) RunOptions
+
+	mu    sync.Mutex
+	steps []PlanStep
+}
+
+func newDryRun(rt Runtime) *dryRun {
+	d := &dryRun{
+		Runtime: rt,
+		// runtimes without CLI are shown as equivalent docker commands
+		cli: &dockerCLI{docker: "docker"},
+	}
+
+	switch r := rt.(type) {
+	case *dockerCLI:
+		d.cli = r
+	case *podmanCLI:
+		d.cli = r.dockerCLI
+		d.translate = r.runOptions
+	case *buildxCLI:
+		d.cli = r.dockerCLI
+		d.buildArgs = r.buildArgs
+	}
+	if d.buildArgs == nil {
+		d.buildArgs = d.cli.buildArgs
+	}
+
+	return d
+}
+
+func (d *dryRun) record(stdin io.Reader, args ...string) {
+	step := PlanStep{
+		Command: append([]string{filepath.Base(d.cli.docker)}, args...),
+	}
+	if f, ok := stdin.(*os.File); ok {
+		step.Stdin = f.Name()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.steps = append(d.steps, step)
+}
+
+func (d *dryRun) Build(opts BuildOptions) error {
+	// the filtered context is streamed by dapper itself, the plan shows
+	// the equivalent build with the context directory
+	opts.Ignore = nil
+	d.record(opts.Stdin, d.buildArgs(opts)...)
+	return nil
+}
+
+func (d *dryRun) Run(opts RunOptions) error {
+	if d.translate != nil {
+		opts = d.translate(opts)
+	}
+	d.record(nil, append([]string{"run"}, d.cli.runArgs(opts)...)...)
+	return nil
+}
+
+func (d *dryRun) Create(opts RunOptions) error {
+	if d.translate != nil {
+		opts = d.translate(opts)
+	}
+	d.record(nil, append([]string{"create"}, d.cli.runArgs(opts)...)...)
+	return nil
+}
+
+func (d *dryRun) CopyTo(container, dir string, content io.Reader) error {
+	d.record(nil, "cp", "-", container+":"+dir)
+	return nil
+}
+
+func (d *dryRun) Start(opts RunOptions) error {
+	d.record(nil, d.cli.startArgs(opts)...)
+	return nil
+}
+
+func (d *dryRun) Tag(source, target string) error {
+	d.record(nil, "tag", source, target)
+	return nil
+}
+
+func (d *dryRun) Push(ref string) error {
+	d.record(nil, "push", ref)
+	return nil
+}
+
+func (d *dryRun) Pull(ref string) error {
+	d.record(nil, "pull", ref)
+	return nil
+}
+
+func (d *dryRun) Cp(src, dst string) error {
+	d.record(nil, "cp", src, dst)
+	return nil
+}
+
+func (d *dryRun) CopyFrom(container, src string, w io.Writer) error {
+	d.record(nil, "cp", container+":"+src, "-")
+	return nil
+}
+
+func (d *dryRun) CreateVolume(name string, labels map[string]string) error {
+	args := []string{"volume", "create"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	d.record(nil, append(args, name)...)
+	return nil
+}
+
+func (d *dryRun) RemoveVolume(name string) error {
+	d.record(nil, "volume", "rm", name)
+	return nil
+}
+
+func (d *dryRun) CreateNetwork(name string, labels map[string]string) error {
+	args := []string{"network", "create"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	d.record(nil, append(args, name)...)
+	return nil
+}
+
+func (d *dryRun) RemoveNetwork(name string) error {
+	d.record(nil, "network", "rm", name)
+	return nil
+}
+
+func (d *dryRun) Exec(name string, command []string) error {
+	d.record(nil, append([]string{"exec", name}, command...)...)
+	return nil
+}
+
+func (d *dryRun) RemoveImage(ref string) error {
+	d.record(nil, "rmi", ref)
+	return nil
+}
+
+func (d *dryRun) Kill(name, signal string) error {
+	d.record(nil, "kill", "--signal", signal, name)
+	return nil
+}
+
+func (d *dryRun) Rm(name string) error {
+	d.record(nil, "rm", "-fv", name)
+	return nil
+}
+
+// DryRun makes all following operations only record the commands they
+// would run, see PrintPlan.
+func (d *Dapperfile) DryRun() {
+	if _, ok := d.runtime.(*dryRun); !ok {
+		d.runtime = newDryRun(d.runtime)
+	}
+}
+
+func (d *Dapperfile) isDryRun() bool {
+	_, ok := d.runtime.(*dryRun)
+	return ok
+}
+
+// PrintPlan writes the commands recorded since DryRun as shell commands or,
+// with format "json", as JSON document.
+func (d *Dapperfile) PrintPlan(w io.Writer, format string) error {
+	dry, ok := d.runtime.(*dryRun)
+	if !ok {
+		return fmt.Errorf("dry run is not enabled")
+	}
+
+	plan := Plan{
+		Image:      d.ImageNameWithTag(),
+		HostArch:   d.hostArch,
+		Mode:       d.env.Mode(d.Mode),
+		BuildArgs:  d.Args,
+		Retargeted: d.retargeted,
+		Steps:      dry.steps,
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	case "", "shell":
+	default:
+		return fmt.Errorf("unknown output format %q, valid formats are: shell, json", format)
+	}
+
+	fmt.Fprintf(w, "# image: %s\n", plan.Image)
+	fmt.Fprintf(w, "# host arch: %s\n", plan.HostArch)
+	fmt.Fprintf(w, "# mode: %s\n", plan.Mode)
+	fmt.Fprintf(w, "# build args: %s\n", shellQuote(plan.BuildArgs))
+	for _, r := range plan.Retargeted {
+		fmt.Fprintf(w, "# stage %s: %s retargeted to %s\n", r.Stage, r.Image, r.BaseImage)
+	}
+	for _, step := range plan.Steps {
+		line := shellQuote(step.Command)
+		if step.Stdin != "" {
+			line += " < " + shellQuote([]string{step.Stdin})
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	return nil
+}
+
+// shellQuote joins args to a command line which can be pasted into sh.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !unsafeShellRe.MatchString(arg) {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,1080 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/term"
+	log "github.com/sirupsen/logrus"
+)
+
+const engineAPIVersion = "v1.25"
+
+var (
+	// ErrUnsupported is wrapped by errors for options a runtime can not
+	// express, e.g. unknown DAPPER_RUN_ARGS for the engine API.
+	ErrUnsupported = errors.New("not supported by runtime")
+)
+
+// EngineError is returned when the docker engine API answers a request
+// with an error.
+type EngineError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *EngineError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("docker engine: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err is an engine error for a missing
+// image or container.
+func IsNotFound(err error) bool {
+	var engineErr *EngineError
+	return errors.As(err, &engineErr) && engineErr.StatusCode == http.StatusNotFound
+}
+
+// ExitError is returned by runtimes which do not run the container as child
+// process when the container exits with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit status of the container.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// engine implements Runtime by talking to the docker engine API over
+// DOCKER_HOST, which does not require the docker CLI to be installed.
+type engine struct {
+	network string
+	address string
+	client  *http.Client
+	// tls is set for TCP hosts with DOCKER_TLS_VERIFY, DOCKER_TLS or the
+	// https scheme.
+	tls *tls.Config
+}
+
+func newEngine() (Runtime, error) {
+	network, address := "unix", "/var/run/docker.sock"
+	https := false
+
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "unix":
+			address = u.Path
+		case "tcp", "http", "https":
+			network, address = "tcp", u.Host
+			https = u.Scheme == "https"
+		default:
+			return nil, fmt.Errorf("DOCKER_HOST %s: scheme %q %w", host, u.Scheme, ErrUnsupported)
+		}
+	}
+
+	e := newEngineForAddress(network, address)
+	if network == "tcp" {
+		cfg, err := engineTLSConfig(address, https)
+		if err != nil {
+			return nil, err
+		}
+		e.tls = cfg
+	}
+	return e, nil
+}
+
+// engineTLSConfig returns the TLS config for the daemon at address like
+// the docker CLI: DOCKER_TLS_VERIFY verifies the daemon against ca.pem of
+// DOCKER_CERT_PATH (~/.docker by default), DOCKER_TLS skips the
+// verification and cert.pem and key.pem are sent as client certificate if
+// they exist. It returns nil if TLS is not enabled.
+func engineTLSConfig(address string, https bool) (*tls.Config, error) {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if !verify && os.Getenv("DOCKER_TLS") == "" && !https {
+		return nil, nil
+	}
+
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: !verify && os.Getenv("DOCKER_TLS") != "",
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		cfg.ServerName = host
+	}
+
+	if verify {
+		ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("DOCKER_TLS_VERIFY is set: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("DOCKER_TLS_VERIFY is set: no certificate in %s", filepath.Join(certPath, "ca.pem"))
+		}
+	}
+
+	cert, key := filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem")
+	if _, err := os.Stat(cert); err == nil {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate of %s: %v", certPath, err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return cfg, nil
+}
+
+func newEngineForAddress(network, address string) *engine {
+	e := &engine{
+		network: network,
+		address: address,
+	}
+	e.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return e.dial()
+			},
+		},
+	}
+	return e
+}
+
+func (e *engine) Name() string {
+	return "engine"
+}
+
+func (e *engine) dial() (net.Conn, error) {
+	conn, err := net.Dial(e.network, e.address)
+	if err != nil || e.tls == nil {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, e.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (e *engine) url(path string, query url.Values) string {
+	u := "http://docker/" + engineAPIVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (e *engine) do(method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, e.url(path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	log.Debugf("Engine %s %s", method, req.URL)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	return resp, nil
+}
+
+// doJSON sends in as JSON body and decodes the response into out, both can
+// be nil.
+func (e *engine) doJSON(method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	header := http.Header{}
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+		header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.do(method, path, query, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func responseError(resp *http.Response) error {
+	content, _ := ioutil.ReadAll(resp.Body)
+
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(content, &msg); err != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(content))
+	}
+
+	return &EngineError{
+		StatusCode: resp.StatusCode,
+		Message:    msg.Message,
+	}
+}
+
+// jsonMessage is a single progress message of build, pull and push.
+type jsonMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// streamMessages prints the progress messages of r to w and returns the
+// first error reported by the engine.
+func streamMessages(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg jsonMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != "" {
+			return &EngineError{Message: msg.Error}
+		}
+
+		switch {
+		case msg.Stream != "":
+			fmt.Fprint(w, msg.Stream)
+		case msg.Status != "" && msg.ID != "":
+			fmt.Fprintf(w, "%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+		case msg.Status != "":
+			fmt.Fprintln(w, msg.Status)
+		}
+	}
+}
+
+func (e *engine) Arch() (string, error) {
+	var version struct {
+		Arch string
+	}
+	if err := e.doJSON("GET", "/version", nil, nil, &version); err != nil {
+		return "", err
+	}
+	return version.Arch, nil
+}
+
+func (e *engine) Build(opts BuildOptions) error {
+	if len(opts.Extra) > 0 {
+		return fmt.Errorf("build arguments %v: %w", opts.Extra, ErrUnsupported)
+	}
+	if opts.Platform != "" {
+		return fmt.Errorf("platform %s: %w", opts.Platform, ErrUnsupported)
+	}
+	if len(opts.CacheFrom) > 0 || len(opts.CacheTo) > 0 || len(opts.Secrets) > 0 || len(opts.SSH) > 0 {
+		return fmt.Errorf("BuildKit options, use the buildx runtime: %w", ErrUnsupported)
+	}
+
+	query := url.Values{}
+	query.Set("dockerfile", opts.File)
+	query.Set("rm", "1")
+	if opts.Tag != "" {
+		query.Set("t", opts.Tag)
+	}
+	if opts.Quiet {
+		query.Set("q", "1")
+	}
+	if opts.Pull {
+		query.Set("pull", "1")
+	}
+
+	buildArgs := map[string]string{}
+	for _, arg := range opts.BuildArgs {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 2 {
+			buildArgs[kv[0]] = kv[1]
+		}
+	}
+	if len(buildArgs) > 0 {
+		content, err := json.Marshal(buildArgs)
+		if err != nil {
+			return err
+		}
+		query.Set("buildargs", string(content))
+	}
+
+	if len(opts.Labels) > 0 {
+		content, err := json.Marshal(opts.Labels)
+		if err != nil {
+			return err
+		}
+		query.Set("labels", string(content))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		if opts.Stdin != nil {
+			content, err := ioutil.ReadAll(opts.Stdin)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.CloseWithError(tarFile(pw, "Dockerfile", content))
+			return
+		}
+
+		pw.CloseWithError(tarContext(pw, buildContext(opts), opts.File, opts.Ignore))
+	}()
+
+	if opts.Stdin != nil {
+		query.Set("dockerfile", "Dockerfile")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	resp, err := e.do("POST", "/build", query, pr, header)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	defer resp.Body.Close()
+
+	return streamMessages(resp.Body, stdout(opts.Stdout))
+}
+
+type engineContainerConfig struct {
+	Image        string
+	Cmd          []string `json:",omitempty"`
+	Entrypoint   []string `json:",omitempty"`
+	Env          []string
+	User         string `json:",omitempty"`
+	WorkingDir   string `json:",omitempty"`
+	Tty          bool
+	OpenStdin    bool
+	StdinOnce    bool
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	Labels       map[string]string `json:",omitempty"`
+	HostConfig   engineHostConfig
+	// NetworkingConfig holds the aliases of the container on the
+	// network of HostConfig.NetworkMode.
+	NetworkingConfig *engineNetworkingConfig `json:",omitempty"`
+}
+
+type engineNetworkingConfig struct {
+	EndpointsConfig map[string]engineEndpointConfig
+}
+
+type engineEndpointConfig struct {
+	Aliases []string `json:",omitempty"`
+}
+
+type engineHostConfig struct {
+	Binds       []string
+	Privileged  bool
+	NetworkMode string   `json:",omitempty"`
+	CapAdd      []string `json:",omitempty"`
+	CapDrop     []string `json:",omitempty"`
+	SecurityOpt []string `json:",omitempty"`
+	ExtraHosts  []string `json:",omitempty"`
+	DNS         []string `json:"Dns,omitempty"`
+}
+
+// containerConfig translates opts into the create request of the engine.
+func (e *engine) containerConfig(opts RunOptions) (*engineContainerConfig, error) {
+	config := &engineContainerConfig{
+		Image:        opts.Image,
+		Cmd:          opts.Command,
+		Tty:          opts.TTY,
+		OpenStdin:    opts.Interactive,
+		StdinOnce:    opts.Interactive,
+		AttachStdin:  opts.Interactive,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	if opts.Entrypoint != "" {
+		config.Entrypoint = []string{opts.Entrypoint}
+	}
+
+	config.HostConfig.Binds = append(config.HostConfig.Binds, opts.Volumes...)
+
+	if opts.Network != "" {
+		config.HostConfig.NetworkMode = opts.Network
+		config.NetworkingConfig = &engineNetworkingConfig{
+			EndpointsConfig: map[string]engineEndpointConfig{
+				opts.Network: {Aliases: opts.NetworkAliases},
+			},
+		}
+	}
+
+	for k, v := range opts.Labels {
+		if config.Labels == nil {
+			config.Labels = map[string]string{}
+		}
+		config.Labels[k] = v
+	}
+
+	if opts.Socket {
+		config.HostConfig.Binds = append(config.HostConfig.Binds, fmt.Sprintf("%s:/var/run/docker.sock", hostSocket()))
+	}
+
+	if opts.MapUser {
+		config.User = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+		config.HostConfig.Binds = append(config.HostConfig.Binds, "/etc/passwd:/etc/passwd:ro", "/etc/group:/etc/group:ro")
+	}
+
+	env := opts.Env
+	args := opts.RunArgs
+	for len(args) > 0 {
+		flag, value := args[0], ""
+		args = args[1:]
+
+		if kv := strings.SplitN(flag, "=", 2); len(kv) == 2 && strings.HasPrefix(flag, "-") {
+			flag, value = kv[0], kv[1]
+		} else if flag != "--privileged" && flag != "--rm" && flag != "--init" {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("run argument %s requires a value", flag)
+			}
+			value, args = args[0], args[1:]
+		}
+
+		switch flag {
+		case "--privileged":
+			config.HostConfig.Privileged = true
+		case "--rm", "--init":
+		case "-e", "--env":
+			env = append(env, value)
+		case "-v", "--volume":
+			config.HostConfig.Binds = append(config.HostConfig.Binds, value)
+		case "--net", "--network":
+			if opts.Network != "" && value != opts.Network {
+				return nil, fmt.Errorf("run argument %s %s conflicts with network %s", flag, value, opts.Network)
+			}
+			config.HostConfig.NetworkMode = value
+		case "-w", "--workdir":
+			config.WorkingDir = value
+		case "-u", "--user":
+			config.User = value
+		case "--cap-add":
+			config.HostConfig.CapAdd = append(config.HostConfig.CapAdd, value)
+		case "--cap-drop":
+			config.HostConfig.CapDrop = append(config.HostConfig.CapDrop, value)
+		case "--security-opt":
+			config.HostConfig.SecurityOpt = append(config.HostConfig.SecurityOpt, value)
+		case "--add-host":
+			config.HostConfig.ExtraHosts = append(config.HostConfig.ExtraHosts, value)
+		case "--dns":
+			config.HostConfig.DNS = append(config.HostConfig.DNS, value)
+		case "-l", "--label":
+			if config.Labels == nil {
+				config.Labels = map[string]string{}
+			}
+			kv := strings.SplitN(value, "=", 2)
+			config.Labels[kv[0]] = strings.Join(kv[1:], "")
+		default:
+			return nil, fmt.Errorf("run argument %s: %w", flag, ErrUnsupported)
+		}
+	}
+
+	// like the docker CLI, plain names are taken from the host env
+	for _, item := range env {
+		if strings.Contains(item, "=") {
+			config.Env = append(config.Env, item)
+		} else if v, ok := os.LookupEnv(item); ok {
+			config.Env = append(config.Env, item+"="+v)
+		}
+	}
+
+	return config, nil
+}
+
+func (e *engine) Run(opts RunOptions) error {
+	id, err := e.create(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Detach {
+		return e.doJSON("POST", "/containers/"+id+"/start", nil, nil, nil)
+	}
+
+	if opts.Remove {
+		defer e.Rm(id)
+	}
+
+	return e.attachAndWait(id, opts)
+}
+
+func (e *engine) Create(opts RunOptions) error {
+	_, err := e.create(opts)
+	return err
+}
+
+func (e *engine) Start(opts RunOptions) error {
+	if opts.Remove {
+		defer e.Rm(opts.Name)
+	}
+	return e.attachAndWait(opts.Name, opts)
+}
+
+func (e *engine) CopyTo(container, dir string, content io.Reader) error {
+	query := url.Values{}
+	query.Set("path", dir)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	resp, err := e.do("PUT", "/containers/"+container+"/archive", query, content, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// create creates the container for opts and returns its id.
+func (e *engine) create(opts RunOptions) (string, error) {
+	if opts.Platform != "" {
+		return "", fmt.Errorf("platform %s: %w", opts.Platform, ErrUnsupported)
+	}
+
+	config, err := e.containerConfig(opts)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	if opts.Name != "" {
+		query.Set("name", opts.Name)
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := e.doJSON("POST", "/containers/create", query, config, &created); err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+func (e *engine) attachAndWait(id string, opts RunOptions) error {
+	query := url.Values{}
+	query.Set("stream", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	if opts.Interactive {
+		query.Set("stdin", "1")
+	}
+
+	conn, br, err := e.hijack("POST", "/containers/"+id+"/attach", query)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if opts.TTY && term.IsTerminal(os.Stdin.Fd()) {
+		state, err := term.SetRawTerminal(os.Stdin.Fd())
+		if err == nil {
+			defer term.RestoreTerminal(os.Stdin.Fd(), state)
+		}
+	}
+
+	if err := e.doJSON("POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return err
+	}
+
+	if opts.TTY {
+		e.resize(id)
+		stop := notifyResize(func() { e.resize(id) })
+		defer stop()
+	}
+
+	if opts.Interactive {
+		go func() {
+			io.Copy(conn, os.Stdin)
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}()
+	}
+
+	if opts.TTY {
+		_, err = io.Copy(stdout(opts.Stdout), br)
+	} else {
+		err = demuxStream(br, stdout(opts.Stdout), stderr(opts.Stderr))
+	}
+	if err != nil {
+		log.Debugf("Failed reading output of %s: %v", id, err)
+	}
+
+	var result struct {
+		StatusCode int
+	}
+	if err := e.doJSON("POST", "/containers/"+id+"/wait", nil, nil, &result); err != nil {
+		return err
+	}
+
+	if result.StatusCode != 0 {
+		return &ExitError{Code: result.StatusCode}
+	}
+	return nil
+}
+
+func (e *engine) resize(id string) {
+	ws, err := term.GetWinsize(os.Stdin.Fd())
+	if err != nil {
+		return
+	}
+
+	query := url.Values{}
+	query.Set("h", fmt.Sprint(ws.Height))
+	query.Set("w", fmt.Sprint(ws.Width))
+	if err := e.doJSON("POST", "/containers/"+id+"/resize", query, nil, nil); err != nil {
+		log.Debugf("Failed to resize tty of %s: %v", id, err)
+	}
+}
+
+// hijack sends an upgrade request and returns the raw connection for
+// streaming stdin/stdout of a container.
+func (e *engine) hijack(method, path string, query url.Values) (net.Conn, *bufio.Reader, error) {
+	req, err := http.NewRequest(method, e.url(path, query), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := e.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, responseError(resp)
+	}
+
+	return conn, br, nil
+}
+
+// demuxStream splits the multiplexed stdout/stderr stream of a container
+// without tty into stdout and stderr.
+func demuxStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *engine) Inspect(ref string) (*ImageInfo, error) {
+	var image struct {
+		ID              string `json:"Id"`
+		Architecture    string
+		ContainerConfig struct {
+			Env []string
+		}
+		Config struct {
+			Env    []string
+			Labels map[string]string
+		}
+	}
+	if err := e.doJSON("GET", "/images/"+ref+"/json", nil, nil, &image); err != nil {
+		return nil, err
+	}
+
+	env := image.ContainerConfig.Env
+	if len(env) == 0 {
+		// BuildKit leaves the container config empty
+		env = image.Config.Env
+	}
+
+	return &ImageInfo{
+		ID:           image.ID,
+		Architecture: image.Architecture,
+		Env:          env,
+		Labels:       image.Config.Labels,
+	}, nil
+}
+
+func (e *engine) Tag(source, target string) error {
+	repo, tag := splitReference(target)
+
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+	return e.doJSON("POST", "/images/"+source+"/tag", query, nil, nil)
+}
+
+func (e *engine) Push(ref string) error {
+	repo, tag := splitReference(ref)
+
+	query := url.Values{}
+	query.Set("tag", tag)
+
+	header := http.Header{}
+	header.Set("X-Registry-Auth", registryAuth(repo))
+
+	resp, err := e.do("POST", "/images/"+repo+"/push", query, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return streamMessages(resp.Body, os.Stdout)
+}
+
+func (e *engine) Pull(ref string) error {
+	repo, tag := splitReference(ref)
+
+	query := url.Values{}
+	query.Set("fromImage", repo)
+	query.Set("tag", tag)
+
+	header := http.Header{}
+	header.Set("X-Registry-Auth", registryAuth(repo))
+
+	resp, err := e.do("POST", "/images/create", query, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return streamMessages(resp.Body, os.Stdout)
+}
+
+func (e *engine) Cp(src, dst string) error {
+	if container, p, ok := splitContainerPath(src); ok {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(e.CopyFrom(container, p, pw))
+		}()
+		defer pr.Close()
+
+		return untar(pr, dst)
+	}
+
+	container, p, ok := splitContainerPath(dst)
+	if !ok {
+		return fmt.Errorf("cp %s %s: one path has to be in a container", src, dst)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarPath(pw, src))
+	}()
+
+	query := url.Values{}
+	query.Set("path", p)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	resp, err := e.do("PUT", "/containers/"+container+"/archive", query, pr, header)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e *engine) CopyFrom(container, src string, w io.Writer) error {
+	query := url.Values{}
+	query.Set("path", src)
+
+	resp, err := e.do("GET", "/containers/"+container+"/archive", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (e *engine) List(kind, label string) ([]Resource, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("filters", string(filters))
+	if kind == "container" {
+		query.Set("all", "1")
+	}
+
+	if kind == "volume" {
+		var volumes struct {
+			Volumes []struct {
+				Name      string
+				CreatedAt time.Time
+				Labels    map[string]string
+			}
+		}
+		if err := e.doJSON("GET", "/volumes", query, nil, &volumes); err != nil {
+			return nil, err
+		}
+
+		resources := []Resource{}
+		for _, v := range volumes.Volumes {
+			resources = append(resources, Resource{
+				ID:      v.Name,
+				Names:   []string{v.Name},
+				Labels:  v.Labels,
+				Created: v.CreatedAt,
+			})
+		}
+		return resources, nil
+	}
+
+	var items []struct {
+		ID       string `json:"Id"`
+		Names    []string
+		RepoTags []string
+		Created  int64
+		Labels   map[string]string
+		State    string
+	}
+	if err := e.doJSON("GET", "/"+kind+"s/json", query, nil, &items); err != nil {
+		return nil, err
+	}
+
+	resources := []Resource{}
+	for _, item := range items {
+		names := item.RepoTags
+		if kind == "container" {
+			names = []string{}
+			for _, name := range item.Names {
+				names = append(names, strings.TrimPrefix(name, "/"))
+			}
+		}
+		resources = append(resources, Resource{
+			ID:      item.ID,
+			Names:   names,
+			Labels:  item.Labels,
+			Created: time.Unix(item.Created, 0),
+			Running: item.State == "running",
+		})
+	}
+	return resources, nil
+}
+
+func (e *engine) CreateVolume(name string, labels map[string]string) error {
+	return e.doJSON("POST", "/volumes/create", nil, map[string]interface{}{
+		"Name":   name,
+		"Labels": labels,
+	}, nil)
+}
+
+func (e *engine) RemoveVolume(name string) error {
+	return e.doJSON("DELETE", "/volumes/"+name, nil, nil, nil)
+}
+
+func (e *engine) CreateNetwork(name string, labels map[string]string) error {
+	return e.doJSON("POST", "/networks/create", nil, map[string]interface{}{
+		"Name":           name,
+		"Driver":         "bridge",
+		"CheckDuplicate": true,
+		"Labels":         labels,
+	}, nil)
+}
+
+func (e *engine) RemoveNetwork(name string) error {
+	return e.doJSON("DELETE", "/networks/"+name, nil, nil, nil)
+}
+
+func (e *engine) Exec(name string, command []string) error {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := e.doJSON("POST", "/containers/"+name+"/exec", nil, map[string]interface{}{
+		"Cmd": command,
+	}, &created)
+	if err != nil {
+		return err
+	}
+
+	if err := e.doJSON("POST", "/exec/"+created.ID+"/start", nil, map[string]interface{}{
+		"Detach": true,
+	}, nil); err != nil {
+		return err
+	}
+
+	for {
+		var state struct {
+			Running  bool
+			ExitCode int
+		}
+		if err := e.doJSON("GET", "/exec/"+created.ID+"/json", nil, nil, &state); err != nil {
+			return err
+		}
+		if !state.Running {
+			if state.ExitCode != 0 {
+				return &ExitError{Code: state.ExitCode}
+			}
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (e *engine) RemoveImage(ref string) error {
+	return e.doJSON("DELETE", "/images/"+ref, nil, nil, nil)
+}
+
+func (e *engine) Kill(name, signal string) error {
+	query := url.Values{}
+	query.Set("signal", signal)
+	return e.doJSON("POST", "/containers/"+name+"/kill", query, nil, nil)
+}
+
+func (e *engine) Rm(name string) error {
+	query := url.Values{}
+	query.Set("force", "1")
+	query.Set("v", "1")
+	return e.doJSON("DELETE", "/containers/"+name, query, nil, nil)
+}
+
+// splitReference splits an image reference into repository and tag, the
+// tag defaults to latest. Like the docker CLI a digest, as in
+// "image:tag@sha256:...", takes the place of the tag.
+func splitReference(ref string) (string, string) {
+	digest := ""
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref, digest = ref[:i], ref[i+1:]
+	}
+
+	repo, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	if digest != "" {
+		return repo, digest
+	}
+	return repo, tag
+}
+
+// splitContainerPath splits "container:path" as used by `docker cp`.
+func splitContainerPath(p string) (string, string, bool) {
+	if filepath.IsAbs(p) || strings.HasPrefix(p, ".") {
+		return "", p, false
+	}
+	parts := strings.SplitN(p, ":", 2)
+	if len(parts) != 2 {
+		return "", p, false
+	}
+	return parts[0], parts[1], true
+}
+
+// registryAuth returns the X-Registry-Auth header for repo, using the
+// credentials stored by `docker login` if there are any.
+func registryAuth(repo string) string {
+	auth := map[string]string{}
+
+	registry := "https://index.docker.io/v1/"
+	if parts := strings.SplitN(repo, "/", 2); len(parts) == 2 && strings.ContainsAny(parts[0], ".:") {
+		registry = parts[0]
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		var config struct {
+			Auths map[string]struct {
+				Auth string `json:"auth"`
+			} `json:"auths"`
+		}
+		content, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
+		if err == nil && json.Unmarshal(content, &config) == nil {
+			if decoded, err := base64.StdEncoding.DecodeString(config.Auths[registry].Auth); err == nil {
+				if kv := strings.SplitN(string(decoded), ":", 2); len(kv) == 2 {
+					auth["username"], auth["password"] = kv[0], kv[1]
+					auth["serveraddress"] = registry
+				}
+			}
+		}
+	}
+
+	content, _ := json.Marshal(auth)
+	return base64.URLEncoding.EncodeToString(content)
+}
@@ -0,0 +1,520 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newFakeEngine returns an engine talking to a server which answers with
+// handlers keyed by "METHOD /path", the path without the API version.
+func newFakeEngine(t *testing.T, handlers map[string]http.HandlerFunc) *engine {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveFake(handlers, w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return newEngineForAddress("tcp", srv.Listener.Addr().String())
+}
+
+func serveFake(handlers map[string]http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/"+engineAPIVersion)
+	handler, ok := handlers[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message":"no handler for %s"}`, key)
+		return
+	}
+	handler(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// tarEntries returns the names of the entries of a tar stream and the
+// content of the regular files.
+func tarEntries(t *testing.T, r io.Reader) ([]string, map[string]string) {
+	t.Helper()
+	names := []string{}
+	files := map[string]string{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			content, _ := ioutil.ReadAll(tr)
+			files[hdr.Name] = string(content)
+		}
+	}
+	sort.Strings(names)
+	return names, files
+}
+
+func TestEngineTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveFake(map[string]http.HandlerFunc{
+			"GET /version": func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, map[string]string{"Arch": "arm64"})
+			},
+		}, w, r)
+	}))
+	defer srv.Close()
+
+	certs := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	ioutil.WriteFile(filepath.Join(certs, "ca.pem"), ca, 0644)
+
+	t.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", certs)
+
+	e, err := newEngine()
+	if err != nil {
+		t.Fatalf("newEngine: %v", err)
+	}
+	if arch, err := e.Arch(); err != nil || arch != "arm64" {
+		t.Errorf("Arch = %q, %v, want arm64", arch, err)
+	}
+
+	t.Setenv("DOCKER_CERT_PATH", t.TempDir())
+	if _, err := newEngine(); err == nil {
+		t.Error("expected an error for DOCKER_TLS_VERIFY without ca.pem")
+	}
+}
+
+func TestEngineBuild(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"Dockerfile.dapper": "FROM alpine\n",
+		"main.go":           "package main\n",
+		"bin/app":           "binary",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	var query map[string]string
+	var names []string
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /build": func(w http.ResponseWriter, r *http.Request) {
+			query = map[string]string{}
+			for k := range r.URL.Query() {
+				query[k] = r.URL.Query().Get(k)
+			}
+			names, _ = tarEntries(t, r.Body)
+			writeJSON(w, map[string]string{"stream": "Step 1/1 : FROM alpine\n"})
+			writeJSON(w, map[string]string{"stream": "Successfully built 1234\n"})
+		},
+	})
+
+	out := &bytes.Buffer{}
+	err := e.Build(BuildOptions{
+		Tag:       "project:tag",
+		File:      "Dockerfile.dapper",
+		Context:   dir,
+		BuildArgs: []string{"DAPPER_HOST_ARCH=amd64"},
+		Labels:    map[string]string{ProjectLabel: "project"},
+		Pull:      true,
+		Ignore:    []string{"bin", "Dockerfile*"},
+		Stdout:    out,
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	want := map[string]string{
+		"t":          "project:tag",
+		"dockerfile": "Dockerfile.dapper",
+		"rm":         "1",
+		"pull":       "1",
+		"buildargs":  `{"DAPPER_HOST_ARCH":"amd64"}`,
+		"labels":     `{"dapper.project":"project"}`,
+	}
+	if !reflect.DeepEqual(query, want) {
+		t.Errorf("query = %v, want %v", query, want)
+	}
+	if want := []string{"Dockerfile.dapper", "main.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("context = %v, want %v", names, want)
+	}
+	if want := "Step 1/1 : FROM alpine\nSuccessfully built 1234\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestEngineBuildStdin(t *testing.T) {
+	var files map[string]string
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /build": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.URL.Query().Get("dockerfile"); got != "Dockerfile" {
+				t.Errorf("dockerfile = %q, want Dockerfile", got)
+			}
+			_, files = tarEntries(t, r.Body)
+		},
+	})
+
+	if err := e.Build(BuildOptions{File: "-", Stdin: strings.NewReader("FROM alpine\n")}); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if want := map[string]string{"Dockerfile": "FROM alpine\n"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("context = %v, want %v", files, want)
+	}
+}
+
+func TestEngineBuildErrors(t *testing.T) {
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /build": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			if r.URL.Query().Get("t") == "bad" {
+				w.WriteHeader(http.StatusInternalServerError)
+				writeJSON(w, map[string]string{"message": "engine broke"})
+				return
+			}
+			writeJSON(w, map[string]string{"stream": "Step 1/2 : RUN false\n"})
+			writeJSON(w, map[string]interface{}{
+				"error":       "The command '/bin/sh -c false' returned a non-zero code: 1",
+				"errorDetail": map[string]interface{}{"code": 1, "message": "The command '/bin/sh -c false' returned a non-zero code: 1"},
+			})
+		},
+	})
+
+	stdin := func() io.Reader { return strings.NewReader("FROM alpine\n") }
+
+	err := e.Build(BuildOptions{Tag: "failing", Stdin: stdin(), Stdout: ioutil.Discard})
+	engineErr, ok := err.(*EngineError)
+	if !ok || !strings.Contains(engineErr.Message, "non-zero code: 1") {
+		t.Errorf("Build = %v, want the error of the stream", err)
+	}
+
+	err = e.Build(BuildOptions{Tag: "bad", Stdin: stdin()})
+	engineErr, ok = err.(*EngineError)
+	if !ok || engineErr.StatusCode != http.StatusInternalServerError || engineErr.Message != "engine broke" {
+		t.Errorf("Build = %#v, want status 500 and the message", err)
+	}
+
+	if err := e.Build(BuildOptions{Platform: "linux/arm64"}); !strings.Contains(fmt.Sprint(err), ErrUnsupported.Error()) {
+		t.Errorf("Build with platform = %v, want unsupported", err)
+	}
+}
+
+// attachHandler hijacks the attach request and writes the multiplexed
+// frames, stream 1 is stdout and 2 stderr.
+func attachHandler(t *testing.T, frames ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		for _, frame := range frames {
+			header := make([]byte, 8)
+			header[0] = frame[0] - '0'
+			binary.BigEndian.PutUint32(header[4:], uint32(len(frame)-1))
+			buf.Write(header)
+			buf.WriteString(frame[1:])
+		}
+		buf.Flush()
+	}
+}
+
+func TestEngineRun(t *testing.T) {
+	t.Setenv("DAPPER_ENGINE_TEST", "from-host")
+
+	var config engineContainerConfig
+	var removed bool
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /containers/create": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.URL.Query().Get("name"); got != "build" {
+				t.Errorf("name = %q, want build", got)
+			}
+			json.NewDecoder(r.Body).Decode(&config)
+			writeJSON(w, map[string]string{"Id": "c1"})
+		},
+		"POST /containers/c1/attach": attachHandler(t, "1out\n", "2err\n", "1done\n"),
+		"POST /containers/c1/start": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"POST /containers/c1/wait": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]int{"StatusCode": 3})
+		},
+		"DELETE /containers/c1": func(w http.ResponseWriter, r *http.Request) {
+			removed = r.URL.Query().Get("force") == "1"
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	err := e.Run(RunOptions{
+		Name:    "build",
+		Image:   "project:tag",
+		Command: []string{"make", "test"},
+		Remove:  true,
+		Env:     []string{"A=1", "DAPPER_ENGINE_TEST", "UNSET_ENGINE_TEST"},
+		Volumes: []string{"cache:/root/.cache"},
+		RunArgs: []string{"--privileged", "--network", "host", "-e", "B=2"},
+		Labels:  map[string]string{ProjectLabel: "project"},
+		Stdout:  stdout,
+		Stderr:  stderr,
+	})
+
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Run = %v, want exit status 3", err)
+	}
+	if stdout.String() != "out\ndone\n" || stderr.String() != "err\n" {
+		t.Errorf("stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+	if !removed {
+		t.Error("container was not removed")
+	}
+
+	if want := []string{"make", "test"}; !reflect.DeepEqual(config.Cmd, want) {
+		t.Errorf("Cmd = %v, want %v", config.Cmd, want)
+	}
+	if want := []string{"A=1", "DAPPER_ENGINE_TEST=from-host", "B=2"}; !reflect.DeepEqual(config.Env, want) {
+		t.Errorf("Env = %v, want %v", config.Env, want)
+	}
+	if !config.HostConfig.Privileged || config.HostConfig.NetworkMode != "host" {
+		t.Errorf("HostConfig = %+v, want privileged on the host network", config.HostConfig)
+	}
+	if want := []string{"cache:/root/.cache"}; !reflect.DeepEqual(config.HostConfig.Binds, want) {
+		t.Errorf("Binds = %v, want %v", config.HostConfig.Binds, want)
+	}
+	if config.Labels[ProjectLabel] != "project" {
+		t.Errorf("Labels = %v", config.Labels)
+	}
+}
+
+func TestEngineRunSuccess(t *testing.T) {
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /containers/create": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]string{"Id": "c2"})
+		},
+		"POST /containers/c2/attach": attachHandler(t, "1ok\n"),
+		"POST /containers/c2/start": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"POST /containers/c2/wait": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]int{"StatusCode": 0})
+		},
+	})
+
+	out := &bytes.Buffer{}
+	if err := e.Run(RunOptions{Image: "alpine", Stdout: out}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if out.String() != "ok\n" {
+		t.Errorf("output = %q, want %q", out.String(), "ok\n")
+	}
+}
+
+func TestEngineRunUnsupported(t *testing.T) {
+	e := newFakeEngine(t, nil)
+	if err := e.Run(RunOptions{Image: "alpine", RunArgs: []string{"--gpus", "all"}}); !strings.Contains(fmt.Sprint(err), ErrUnsupported.Error()) {
+		t.Errorf("Run = %v, want unsupported", err)
+	}
+}
+
+func TestEngineInspect(t *testing.T) {
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"GET /images/classic/json": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"Id":"sha256:1","Architecture":"arm64","ContainerConfig":{"Env":["DAPPER_OUTPUT=bin"]},"Config":{"Env":["PATH=/bin"],"Labels":{"a":"b"}}}`)
+		},
+		"GET /images/buildkit/json": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"Id":"sha256:2","Architecture":"amd64","ContainerConfig":{},"Config":{"Env":["DAPPER_OUTPUT=dist"]}}`)
+		},
+	})
+
+	info, err := e.Inspect("classic")
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	want := &ImageInfo{ID: "sha256:1", Architecture: "arm64", Env: []string{"DAPPER_OUTPUT=bin"}, Labels: map[string]string{"a": "b"}}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Inspect = %+v, want %+v", info, want)
+	}
+
+	info, err = e.Inspect("buildkit")
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	if want := []string{"DAPPER_OUTPUT=dist"}; !reflect.DeepEqual(info.Env, want) {
+		t.Errorf("Env = %v, want %v", info.Env, want)
+	}
+
+	if _, err := e.Inspect("missing"); !IsNotFound(err) {
+		t.Errorf("Inspect = %v, want not found", err)
+	}
+}
+
+func TestEngineTagAndPull(t *testing.T) {
+	home := t.TempDir()
+	os.MkdirAll(filepath.Join(home, ".docker"), 0700)
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	ioutil.WriteFile(filepath.Join(home, ".docker", "config.json"),
+		[]byte(`{"auths":{"registry.example.com:5000":{"auth":"`+auth+`"}}}`), 0600)
+	t.Setenv("HOME", home)
+
+	var tagQuery, pullQuery map[string]string
+	var registryAuth map[string]string
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"POST /images/project:abc/tag": func(w http.ResponseWriter, r *http.Request) {
+			tagQuery = map[string]string{"repo": r.URL.Query().Get("repo"), "tag": r.URL.Query().Get("tag")}
+			w.WriteHeader(http.StatusCreated)
+		},
+		"POST /images/create": func(w http.ResponseWriter, r *http.Request) {
+			pullQuery = map[string]string{"fromImage": r.URL.Query().Get("fromImage"), "tag": r.URL.Query().Get("tag")}
+			content, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+			registryAuth = map[string]string{}
+			json.Unmarshal(content, &registryAuth)
+			writeJSON(w, map[string]string{"status": "Pulling from app", "id": "1.0"})
+			if pullQuery["tag"] == "missing" {
+				writeJSON(w, map[string]string{"error": "manifest unknown"})
+			}
+		},
+	})
+
+	if err := e.Tag("project:abc", "registry.example.com:5000/app:latest"); err != nil {
+		t.Fatalf("Tag: %v", err)
+	}
+	if want := map[string]string{"repo": "registry.example.com:5000/app", "tag": "latest"}; !reflect.DeepEqual(tagQuery, want) {
+		t.Errorf("tag query = %v, want %v", tagQuery, want)
+	}
+
+	if err := e.Pull("registry.example.com:5000/app:1.0"); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if want := map[string]string{"fromImage": "registry.example.com:5000/app", "tag": "1.0"}; !reflect.DeepEqual(pullQuery, want) {
+		t.Errorf("pull query = %v, want %v", pullQuery, want)
+	}
+	want := map[string]string{"username": "user", "password": "secret", "serveraddress": "registry.example.com:5000"}
+	if !reflect.DeepEqual(registryAuth, want) {
+		t.Errorf("X-Registry-Auth = %v, want %v", registryAuth, want)
+	}
+
+	if err := e.Pull("app:missing"); err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("Pull = %v, want the error of the stream", err)
+	}
+	if len(registryAuth) != 0 {
+		t.Errorf("X-Registry-Auth for docker hub = %v, want no credentials", registryAuth)
+	}
+}
+
+func TestEngineCp(t *testing.T) {
+	var uploaded map[string]string
+	var uploadPath string
+	e := newFakeEngine(t, map[string]http.HandlerFunc{
+		"GET /containers/c1/archive": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.URL.Query().Get("path"); got != "/source/bin" {
+				t.Errorf("path = %q, want /source/bin", got)
+			}
+			tw := tar.NewWriter(w)
+			tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+			tw.WriteHeader(&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 6})
+			tw.Write([]byte("binary"))
+			tw.WriteHeader(&tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "app"})
+			tw.Close()
+		},
+		"PUT /containers/c1/archive": func(w http.ResponseWriter, r *http.Request) {
+			uploadPath = r.URL.Query().Get("path")
+			_, uploaded = tarEntries(t, r.Body)
+		},
+	})
+
+	dst := t.TempDir()
+	if err := e.Cp("c1:/source/bin", dst); err != nil {
+		t.Fatalf("Cp from container: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dst, "bin", "link")); err != nil || string(content) != "binary" {
+		t.Errorf("bin/link = %q, %v", content, err)
+	}
+
+	src := filepath.Join(t.TempDir(), "Makefile")
+	ioutil.WriteFile(src, []byte("all:\n"), 0644)
+	if err := e.Cp(src, "c1:/source"); err != nil {
+		t.Fatalf("Cp to container: %v", err)
+	}
+	if want := map[string]string{"Makefile": "all:\n"}; uploadPath != "/source" || !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded %v to %s, want %v to /source", uploaded, uploadPath, want)
+	}
+
+	if err := e.Cp(src, dst); err == nil {
+		t.Error("Cp between host paths succeeded")
+	}
+}
+
+func TestUntarSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	dst := t.TempDir()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "out", Typeflag: tar.TypeSymlink, Linkname: outside})
+	tw.WriteHeader(&tar.Header{Name: "out/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+
+	if err := untar(buf, dst); err == nil {
+		t.Error("untar followed the symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of dst: %v", err)
+	}
+}
+
+func TestUntarTraversal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+
+	if err := untar(buf, t.TempDir()); err == nil {
+		t.Error("untar extracted ../evil")
+	}
+}
+
+func TestSplitReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		ref, repo, tag string
+	}{
+		{"alpine", "alpine", "latest"},
+		{"alpine:3.8", "alpine", "3.8"},
+		{"localhost:5000/app", "localhost:5000/app", "latest"},
+		{"localhost:5000/app:1.0", "localhost:5000/app", "1.0"},
+		{"alpine@" + digest, "alpine", digest},
+		{"alpine:3.8@" + digest, "alpine", digest},
+		{"localhost:5000/app:1.0@" + digest, "localhost:5000/app", digest},
+	}
+
+	for _, test := range tests {
+		repo, tag := splitReference(test.ref)
+		if repo != test.repo || tag != test.tag {
+			t.Errorf("splitReference(%q) = %q, %q, want %q, %q", test.ref, repo, tag, test.repo, test.tag)
+		}
+	}
+}
@@ -41,6 +41,11 @@ func (c Context) Socket() bool {
 }
 
 func (c Context) HostSocket() string {
+	return hostSocket()
+}
+
+// hostSocket returns the path of the docker daemon socket on the host.
+func hostSocket() string {
 	s := os.Getenv("DOCKER_HOST")
 	if strings.HasPrefix(s, "unix://") {
 		return strings.TrimPrefix(s, "unix://")
@@ -50,7 +55,7 @@ func (c Context) HostSocket() string {
 
 func (c Context) Mode(mode string) string {
 	switch mode {
-	case "cp", "bind":
+	case "cp", "bind", "sync":
 		return mode
 	}
 	return "cp"
@@ -126,6 +131,28 @@ func (c Context) Output() []string {
 	return []string{}
 }
 
+// OutputOnFailure returns the DAPPER_OUTPUT_ON_FAILURE entries which are
+// copied back when the command fails, "always" copies DAPPER_OUTPUT.
+func (c Context) OutputOnFailure() []string {
+	ret := strings.Fields(c["DAPPER_OUTPUT_ON_FAILURE"])
+	if len(ret) == 1 && ret[0] == "always" {
+		return c.Output()
+	}
+	return ret
+}
+
+// Cache returns the DAPPER_CACHE paths, each is backed by a named volume
+// which outlives the build container.
+func (c Context) Cache() []string {
+	return strings.Fields(c["DAPPER_CACHE"])
+}
+
+// CacheScope returns DAPPER_CACHE_SCOPE, "variant" and "arch" give each
+// variant or host architecture its own cache volumes.
+func (c Context) CacheScope() []string {
+	return strings.Fields(strings.Replace(c["DAPPER_CACHE_SCOPE"], ",", " ", -1))
+}
+
 func (c Context) RunArgs() []string {
 	if v, ok := c["DAPPER_RUN_ARGS"]; ok {
 		ret := []string{}
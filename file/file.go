@@ -1,24 +1,21 @@
 package file
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
-	"syscall"
 
 	"path"
 	"text/template"
+	"time"
 
 	"github.com/docker/docker/pkg/term"
+	"github.com/rancher/dapper/dockerfile"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,7 +27,9 @@ var (
 type Dapperfile struct {
 	File        string
 	Mode        string
-	docker      string
+	runtime     Runtime
+	dockerfile  *dockerfile.Dockerfile
+	retargeted  []Retarget
 	env         Context
 	Socket      bool
 	NoOut       bool
@@ -45,63 +44,98 @@ type Dapperfile struct {
 	PullFrom    string
 	Variant     string
 	MountSuffix string
+	// Pull is the pull policy for base images: always, missing or never.
+	Pull string
+	// Rebuild forces a build even if the image is up to date.
+	Rebuild bool
+	// HashFiles are glob patterns of context files which invalidate the
+	// build image when they change.
+	HashFiles []string
+	// TagStrategy selects how Tag is computed, see TagStrategies.
+	TagStrategy string
+	// FixedTag is the tag used by the "fixed" strategy.
+	FixedTag string
+	// Jobs is the number of tasks run in parallel.
+	Jobs int
+	// Timeout stops the build container when it runs longer.
+	Timeout time.Duration
+	// IdleTimeout stops the build container when it does not write any
+	// output for this long.
+	IdleTimeout time.Duration
+	// StopTimeout is the time containers get to exit after a signal was
+	// forwarded to them, see DefaultStopTimeout.
+	StopTimeout time.Duration
+	// GitIgnore leaves the files of .gitignore out of the build context
+	// in addition to .dapperignore.
+	GitIgnore bool
+	// CacheFrom and CacheTo are BuildKit cache locations, plain
+	// directories are local caches.
+	CacheFrom []string
+	CacheTo   []string
+	// Secrets and SSH are passed to BuildKit as --secret and --ssh.
+	Secrets []string
+	SSH     []string
+	// Services are started next to the build container by Run.
+	Services []*Service
+	// Platforms run the command in a build image for each platform,
+	// e.g. linux/arm64, see RunPlatforms.
+	Platforms []string
+	// platform is the platform of this build image, empty for the
+	// platform of the engine.
+	platform string
+	tag      string
+	task     *Task
+	// built is the image built by this process, it is not built again
+	// for further tasks.
+	built string
+	// stdout and stderr receive the output of the build container
+	// instead of the terminal, e.g. when running tasks in parallel.
+	stdout io.Writer
+	stderr io.Writer
 }
 
-func Lookup(file string) (*Dapperfile, error) {
+func Lookup(file string, runtime Runtime) (*Dapperfile, error) {
 	if _, err := os.Stat(file); err != nil {
 		return nil, err
 	}
 
 	d := &Dapperfile{
-		File: file,
+		File:    file,
+		runtime: runtime,
 	}
 
 	return d, d.init()
 }
 
 func (d *Dapperfile) init() error {
-	docker, err := exec.LookPath("docker")
-	if err != nil {
+	var err error
+	if d.dockerfile, err = dockerfile.ParseFile(d.File); err != nil {
 		return err
 	}
-	d.docker = docker
-	if d.Args, err = d.argsFromEnv(d.File); err != nil {
-		return err
+	// the build reports the actual errors, newer syntax must not stop dapper
+	if err := d.dockerfile.Validate(); err != nil {
+		log.Warnf("%s: %v", d.File, err)
 	}
+	d.Args = d.argsFromEnv()
 	if d.hostArch == "" {
 		d.hostArch = d.findHostArch()
 	}
 	return nil
 }
 
-func (d *Dapperfile) argsFromEnv(dockerfile string) ([]string, error) {
-	file, err := os.Open(dockerfile)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
+func (d *Dapperfile) argsFromEnv() []string {
 	r := []string{}
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		fields := strings.Fields(line)
-		if len(fields) <= 1 {
-			continue
-		}
-
-		command := fields[0]
-		if command != "ARG" {
-			continue
-		}
-
-		key := strings.Split(fields[1], "=")[0]
+	for _, key := range d.dockerfile.ArgNames() {
 		value := os.Getenv(key)
 
 		if key == "DAPPER_HOST_ARCH" && value == "" {
 			value = d.findHostArch()
 		}
 
+		if d.platform != "" && (key == "DAPPER_HOST_ARCH" || key == "TARGETARCH") {
+			value = platformArch(d.platform)
+		}
+
 		if key == "DAPPER_HOST_ARCH" {
 			d.hostArch = value
 		}
@@ -111,19 +145,19 @@ func (d *Dapperfile) argsFromEnv(dockerfile string) ([]string, error) {
 		}
 	}
 
-	return r, nil
+	return r
 }
 
 func (d *Dapperfile) RemoteImageNameWithTag(arg string) (string, error) {
 	tmpl, err := template.New("remote-tag").Parse(arg)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	var remoteTag bytes.Buffer
 	err = tmpl.Execute(&remoteTag, d)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	name := remoteTag.String()
@@ -153,11 +187,11 @@ func (d *Dapperfile) PushImage() error {
 		return err
 	}
 
-	err = d.exec("tag", d.ImageNameWithTag(), remoteName)
+	err = d.runtime.Tag(d.ImageNameWithTag(), remoteName)
 	if err != nil {
 		return err
 	}
-	err = d.exec("push", remoteName)
+	err = d.runtime.Push(remoteName)
 	return err
 }
 
@@ -167,13 +201,13 @@ func (d *Dapperfile) PullImage() error {
 		return err
 	}
 
-	err = d.exec("pull", remoteName)
+	err = d.runtime.Pull(remoteName)
 	if err != nil {
 		log.Warnf("Could not pull %s remoteName: %v", remoteName, err)
 		return nil
 	}
 
-	err = d.exec("tag", remoteName, d.ImageNameWithTag())
+	err = d.runtime.Tag(remoteName, d.ImageNameWithTag())
 	if err != nil {
 		return err
 	}
@@ -187,44 +221,46 @@ func (d *Dapperfile) Run(commandArgs []string) error {
 	}
 
 	log.Debugf("Running build in %s", imageNameWithTag)
-	name, args, err := d.runArgs(imageNameWithTag, "", commandArgs)
+	opts, err := d.runArgs(imageNameWithTag, "", commandArgs)
+	if err != nil {
+		return err
+	}
+	name := opts.Name
+
+	// the services are removed after the build container, which is
+	// connected to their network
+	network, stopServices, err := d.startServices(opts)
 	if err != nil {
 		return err
 	}
+	defer stopServices()
+	opts.Network = network
 
 	defer func() {
 		if d.Keep {
 			log.Infof("Keeping build container %s", name)
 		} else {
 			log.Debugf("Deleting temp container %s", name)
-			d.execWithOutput("rm", "-fv", name)
+			d.runtime.Rm(name)
 		}
 	}()
 
-	if err := d.run(args...); err != nil {
-		return err
-	}
-
-	source := d.env.Source()
-	output := d.env.Output()
+	err = d.watch(opts, d.start)
 	if !d.IsBind() && !d.NoOut {
-		for _, i := range output {
-			p := i
-			if !strings.HasPrefix(p, "/") {
-				p = path.Join(source, i)
-			}
-			targetDir := path.Dir(i)
-			if err := os.MkdirAll(targetDir, 0755); err != nil {
-				return err
-			}
-			log.Infof("docker cp %s %s", p, targetDir)
-			if err := d.exec("cp", name+":"+p, targetDir); err != nil {
-				log.Debugf("Error copying back '%s': %s", i, err)
-			}
+		output := d.env.Output()
+		if err != nil {
+			// reports and logs of a failed build, the exit code of
+			// the build is kept
+			output = d.env.OutputOnFailure()
+		}
+		copied := d.copyOutput(name, output)
+		PrintOutputSummary(stdout(d.stdout), copied)
+		if werr := d.writeArtifacts(imageNameWithTag, copied); werr != nil {
+			log.Errorf("Failed to write %s: %v", ArtifactsFile, werr)
 		}
 	}
 
-	return nil
+	return err
 }
 
 func (d *Dapperfile) Shell(commandArgs []string) error {
@@ -234,26 +270,110 @@ func (d *Dapperfile) Shell(commandArgs []string) error {
 	}
 
 	log.Debugf("Running shell in %s", imageNameWithTag)
-	_, args, err := d.runArgs(imageNameWithTag, d.env.Shell(), nil)
-	args = append([]string{"--rm"}, args...)
+	opts, err := d.runArgs(imageNameWithTag, d.env.Shell(), nil)
 	if err != nil {
 		return err
 	}
+	opts.Remove = true
 
-	return d.runExec(args...)
+	network, stopServices, err := d.startServices(opts)
+	if err != nil {
+		return err
+	}
+	defer stopServices()
+	opts.Network = network
+	// dapper has to stay around to remove the services after the shell
+	opts.Replace = len(d.Services) == 0
+
+	return d.start(opts)
 }
 
-func (d *Dapperfile) runArgs(imageNameWithTag, shell string, commandArgs []string) (string, []string, error) {
-	name := fmt.Sprintf("%s-%s", strings.Split(imageNameWithTag, ":")[0], randString())
+// start runs the build container. In cp and sync mode the container is
+// created first and the source is streamed into it before it starts, so
+// the build image stays untouched.
+func (d *Dapperfile) start(opts RunOptions) error {
+	if !d.isDryRun() {
+		defer d.track(opts.Name)()
+	}
+
+	if err := d.createCacheVolumes(); err != nil {
+		return err
+	}
+
+	if d.IsSync() {
+		if err := d.createSyncVolume(); err != nil {
+			return err
+		}
+	}
 
-	args := []string{"-i", "--name", name}
+	if d.IsBind() {
+		return d.runtime.Run(opts)
+	}
 
-	if term.IsTerminal(0) {
-		args = append(args, "-t")
+	if err := d.runtime.Create(opts); err != nil {
+		return err
 	}
 
-	if d.env.Socket() || d.Socket {
-		args = append(args, "-v", fmt.Sprintf("%s:/var/run/docker.sock", d.env.HostSocket()))
+	var err error
+	if d.IsSync() {
+		err = d.syncSource(opts)
+	} else {
+		err = d.copySource(opts.Name)
+	}
+
+	if err != nil {
+		if opts.Remove {
+			d.runtime.Rm(opts.Name)
+		}
+		return err
+	}
+
+	return d.runtime.Start(opts)
+}
+
+// copySource copies DAPPER_CP without the ignored files to DAPPER_SOURCE
+// of container.
+func (d *Dapperfile) copySource(container string) error {
+	ignore, err := d.IgnorePatterns()
+	if err != nil {
+		return err
+	}
+
+	m, err := newIgnoreMatcher(ignore)
+	if err != nil {
+		return err
+	}
+	m = m.below(d.env.Cp())
+
+	source := path.Clean(d.env.Source())
+	log.Debugf("Copying %s to %s:%s", d.env.Cp(), container, source)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(tarDirectory(pw, d.env.Cp(), path.Base(source), m))
+	}()
+
+	return d.runtime.CopyTo(container, path.Dir(source), pr)
+}
+
+func (d *Dapperfile) runArgs(imageNameWithTag, shell string, commandArgs []string) (RunOptions, error) {
+	name := strings.Split(imageNameWithTag, ":")[0]
+	if d.task != nil {
+		name = fmt.Sprintf("%s-%s", name, re.ReplaceAllLiteralString(d.task.Name, "-"))
+	}
+
+	opts := RunOptions{
+		Name:        fmt.Sprintf("%s-%s", name, randString()),
+		Labels:      d.labels(),
+		Image:       imageNameWithTag,
+		Interactive: d.stdout == nil,
+		TTY:         d.stdout == nil && term.IsTerminal(0),
+		Socket:      d.env.Socket() || d.Socket,
+		MapUser:     d.MapUser,
+		Platform:    d.platform,
+		Stdout:      d.stdout,
+		Stderr:      d.stderr,
 	}
 
 	if d.IsBind() {
@@ -263,105 +383,147 @@ func (d *Dapperfile) runArgs(imageNameWithTag, shell string, commandArgs []strin
 			if d.env.MountSuffix(d.MountSuffix) != "" {
 				suffix = ":" + d.env.MountSuffix(d.MountSuffix)
 			}
-			args = append(args, "-v", fmt.Sprintf("%s:%s%s", fmt.Sprintf("%s/%s", wd, d.env.Cp()), d.env.Source(), suffix))
+			opts.Volumes = append(opts.Volumes, fmt.Sprintf("%s:%s%s", fmt.Sprintf("%s/%s", wd, d.env.Cp()), d.env.Source(), suffix))
 		}
+	} else if d.IsSync() {
+		opts.Volumes = append(opts.Volumes, fmt.Sprintf("%s:%s", d.SyncVolume(), path.Clean(d.env.Source())))
 	}
 
-	args = append(args, "-e", fmt.Sprintf("DAPPER_UID=%d", os.Getuid()))
-	args = append(args, "-e", fmt.Sprintf("DAPPER_GID=%d", os.Getgid()))
-	args = append(args, "-e", "DAPPER=1")
+	opts.Env = append(opts.Env, fmt.Sprintf("DAPPER_UID=%d", os.Getuid()))
+	opts.Env = append(opts.Env, fmt.Sprintf("DAPPER_GID=%d", os.Getgid()))
+	opts.Env = append(opts.Env, "DAPPER=1")
 
 	for _, env := range d.env.Env() {
 		log.Debugf("mapping env %s", env)
-		args = append(args, "-e", env)
+		opts.Env = append(opts.Env, env)
 	}
 
 	volumes, err := d.env.Volumes()
 	if err != nil {
-		return "", nil, err
+		return opts, err
 	}
 
 	for _, vol := range volumes {
 		log.Debugf("mapping volume %s", vol)
-		args = append(args, "-v", vol)
+		opts.Volumes = append(opts.Volumes, vol)
 	}
 
-	if shell != "" {
-		args = append(args, "--entrypoint", shell)
-		args = append(args, "-e", "TERM")
+	caches, err := d.cacheVolumes()
+	if err != nil {
+		return opts, err
 	}
 
-	if d.MapUser {
-		args = append(args, "-u", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
-		args = append(args, "-v", "/etc/passwd:/etc/passwd:ro")
-		args = append(args, "-v", "/etc/group:/etc/group:ro")
+	for _, cache := range caches {
+		log.Debugf("mapping cache %s to %s", cache.Name, cache.Path)
+		opts.Volumes = append(opts.Volumes, cache.Name+":"+cache.Path)
 	}
 
-	args = append(args, d.env.RunArgs()...)
-	args = append(args, imageNameWithTag)
+	if shell != "" {
+		opts.Entrypoint = shell
+		opts.Env = append(opts.Env, "TERM")
+	}
+
+	opts.RunArgs = d.env.RunArgs()
 
 	if shell != "" && len(commandArgs) == 0 {
-		args = append(args, "-")
+		opts.Command = []string{"-"}
 	} else {
-		args = append(args, commandArgs...)
+		opts.Command = commandArgs
 	}
 
-	return name, args, nil
+	return opts, nil
 }
 
-func (d *Dapperfile) prebuild() error {
-	f, err := os.Open(d.File)
-	if err != nil {
-		return err
+// Retarget is a build stage whose base image was replaced by the image
+// given for the host architecture in its "# FROM arch=image" comment.
+type Retarget struct {
+	Stage     string `json:"stage"`
+	Image     string `json:"image"`
+	BaseImage string `json:"baseImage"`
+}
+
+// argValues returns the resolved build args by name.
+func (d *Dapperfile) argValues() map[string]string {
+	values := map[string]string{}
+	for _, arg := range d.Args {
+		kv := strings.SplitN(arg, "=", 2)
+		values[kv[0]] = kv[1]
 	}
-	defer f.Close()
+	return values
+}
 
-	scanner := bufio.NewScanner(f)
-	target := ""
+func (d *Dapperfile) prebuild() error {
+	d.retargeted = nil
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "FROM ") {
-			parts := strings.Fields(line)
-			if len(parts) <= 1 {
-				return nil
-			}
+	values := d.argValues()
 
-			target = strings.TrimSpace(parts[1])
-			continue
-		} else if target == "" || !strings.HasPrefix(line, "# FROM ") {
+	retargets := []Retarget{}
+	targets := map[string]string{}
+
+	for _, stage := range d.dockerfile.Stages {
+		baseImage, ok := stage.BaseImages()[d.hostArch]
+		if !ok {
 			continue
 		}
 
-		baseImage, ok := toMap(line)[d.hostArch]
-		if !ok {
-			return nil
+		name := stage.Name
+		if name == "" {
+			name = fmt.Sprint(stage.Index)
 		}
 
 		if baseImage == "skip" {
+			log.Infof("Skipping build, stage %s is marked skip for %s", name, d.hostArch)
 			return ErrSkipBuild
 		}
 
-		_, err := exec.Command(d.docker, "inspect", baseImage).CombinedOutput()
-		if err != nil {
-			if err := d.exec("pull", baseImage); err != nil {
+		target := d.dockerfile.Expand(stage.Image, values)
+		if prev := d.dockerfile.Stage(target); prev != nil && prev.Index < stage.Index {
+			log.Warnf("Ignoring base image of stage %s, it is based on stage %s", name, prev.Name)
+			continue
+		}
+
+		if other, ok := targets[target]; ok && other != baseImage {
+			return fmt.Errorf("stage %s maps %s to %s, but an earlier stage maps it to %s", name, target, baseImage, other)
+		}
+		targets[target] = baseImage
+
+		retargets = append(retargets, Retarget{
+			Stage:     name,
+			Image:     target,
+			BaseImage: baseImage,
+		})
+	}
+
+	for _, r := range retargets {
+		if _, err := d.runtime.Inspect(r.BaseImage); err != nil {
+			if err := d.runtime.Pull(r.BaseImage); err != nil {
 				return err
 			}
 		}
 
-		log.Debugf("Running tag with %s %s", baseImage, target)
-		return d.exec("tag", baseImage, target)
+		log.Debugf("Running tag with %s %s", r.BaseImage, r.Image)
+		if err := d.runtime.Tag(r.BaseImage, r.Image); err != nil {
+			return err
+		}
+		log.Infof("Retargeted stage %s to %s for %s", r.Stage, r.BaseImage, d.hostArch)
 	}
 
-	return scanner.Err()
+	d.retargeted = retargets
+	return nil
+}
+
+// Retargeted returns the stages whose base image was replaced for the host
+// architecture by the last build.
+func (d *Dapperfile) Retargeted() []Retarget {
+	return d.retargeted
 }
 
 func (d *Dapperfile) findHostArch() string {
-	output, err := d.execWithOutput("version", "-f", "{{.Server.Arch}}")
-	if err != nil {
+	arch, err := d.runtime.Arch()
+	if err != nil || arch == "" {
 		return runtime.GOARCH
 	}
-	return strings.TrimSpace(string(output))
+	return arch
 }
 
 func (d *Dapperfile) Build(args []string) error {
@@ -369,133 +531,178 @@ func (d *Dapperfile) Build(args []string) error {
 		return err
 	}
 
-	buildArgs := []string{"build"}
-
-	for _, v := range d.Args {
-		buildArgs = append(buildArgs, "--build-arg", v)
+	opts := BuildOptions{
+		File:      d.File,
+		BuildArgs: d.Args,
+		Labels:    d.labels(),
+		Platform:  d.platform,
+		Extra:     args,
 	}
-	buildArgs = append(buildArgs, args...)
+	d.buildKit(&opts)
 
 	if d.NoContext {
-		buildArgs = append(buildArgs, "-")
-
 		stdinFile, err := os.Open(d.File)
 		if err != nil {
 			return err
 		}
 		defer stdinFile.Close()
 
-		return d.execWithStdin(stdinFile, buildArgs...)
+		opts.Stdin = stdinFile
+		return d.runtime.Build(opts)
 	}
 
-	buildArgs = append(buildArgs, "-f", d.File)
-
-	// Always attempt to pull a newer version of the base image
-	buildArgs = append(buildArgs, "--pull")
+	pull, err := d.pullPolicy()
+	if err != nil {
+		return err
+	}
+	opts.Pull = pull
 
-	return d.exec(buildArgs...)
+	return d.runtime.Build(opts)
 }
 
-func (d *Dapperfile) build() (string, error) {
-	if err := d.prebuild(); err != nil {
-		return "", err
+// pullPolicy reports whether the build should pull newer base images. With
+// the policy "never" all base images have to exist already.
+func (d *Dapperfile) pullPolicy() (bool, error) {
+	switch d.Pull {
+	case "", "always":
+		return true, nil
+	case "missing":
+		return false, nil
+	case "never":
+	default:
+		return false, fmt.Errorf("invalid pull policy %q, valid policies are: always, missing, never", d.Pull)
+	}
+
+	values := d.argValues()
+	for _, stage := range d.dockerfile.Stages {
+		image := d.dockerfile.Expand(stage.Image, values)
+		if image == "scratch" {
+			continue
+		}
+		if prev := d.dockerfile.Stage(image); prev != nil && prev.Index < stage.Index {
+			continue
+		}
+		if _, err := d.runtime.Inspect(image); err != nil {
+			return false, fmt.Errorf("base image %s does not exist and the pull policy is never", image)
+		}
 	}
 
-	imageNameWithTag := d.ImageNameWithTag()
-
-	log.Debugf("Building %s using %s", imageNameWithTag, d.File)
-	buildArgs := []string{"build", "-t", imageNameWithTag}
+	return false, nil
+}
 
-	if d.Quiet {
-		buildArgs = append(buildArgs, "-q")
+// upToDate reports whether the image was built from the same content.
+func (d *Dapperfile) upToDate(imageNameWithTag, hash string) bool {
+	if d.Rebuild {
+		return false
 	}
 
-	for _, v := range d.Args {
-		buildArgs = append(buildArgs, "--build-arg", v)
+	image, err := d.runtime.Inspect(imageNameWithTag)
+	if err != nil {
+		return false
 	}
 
-	// Always attempt to pull a newer version of the base image
-	buildArgs = append(buildArgs, "--pull")
+	return image.Labels[HashLabel] == hash
+}
 
-	if d.NoContext {
-		buildArgs = append(buildArgs, "-")
+func (d *Dapperfile) build() (string, error) {
+	imageNameWithTag, err := d.buildOnce()
+	if err != nil {
+		return "", err
+	}
 
-		stdinFile, err := os.Open(d.File)
-		if err != nil {
-			return "", err
-		}
-		defer stdinFile.Close()
+	if err := d.readEnv(imageNameWithTag); err != nil {
+		return "", err
+	}
 
-		if err := d.execWithStdin(stdinFile, buildArgs...); err != nil {
-			return "", err
-		}
-	} else {
-		buildArgs = append(buildArgs, "-f", d.File)
-		buildArgs = append(buildArgs, ".")
+	return imageNameWithTag, nil
+}
 
-		if err := d.exec(buildArgs...); err != nil {
-			return "", err
-		}
+// buildOnce builds the build image unless it is up to date or was built
+// by this process before.
+func (d *Dapperfile) buildOnce() (string, error) {
+	imageNameWithTag := d.ImageNameWithTag()
+	if d.built == imageNameWithTag {
+		log.Debugf("Reusing %s built before", imageNameWithTag)
+		return imageNameWithTag, nil
 	}
 
-	if err := d.readEnv(imageNameWithTag); err != nil {
+	hash, err := d.ContentHash()
+	if err != nil {
 		return "", err
 	}
 
-	if !d.IsBind() {
-		text := fmt.Sprintf("FROM %s\nCOPY %s %s", imageNameWithTag, d.env.Cp(), d.env.Source())
-		if err := d.buildWithContent(imageNameWithTag, text); err != nil {
-			return "", err
-		}
+	if d.upToDate(imageNameWithTag, hash) {
+		log.Infof("Reusing %s, %s, build args and context files are unchanged", imageNameWithTag, d.File)
+	} else if err := d.buildImage(imageNameWithTag, hash); err != nil {
+		return "", err
 	}
 
+	d.built = imageNameWithTag
 	return imageNameWithTag, nil
 }
 
-func (d *Dapperfile) buildWithContent(tag, content string) error {
-	tempfile, err := ioutil.TempFile(".", d.File)
+func (d *Dapperfile) buildImage(imageNameWithTag, hash string) error {
+	if err := d.prebuild(); err != nil {
+		return err
+	}
+
+	pull, err := d.pullPolicy()
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Created tempfile %s", tempfile.Name())
-	defer func() {
-		log.Debugf("Deleting tempfile %s", tempfile.Name())
-		if err := os.Remove(tempfile.Name()); err != nil {
-			log.Errorf("Failed to delete tempfile %s: %v", tempfile.Name(), err)
+	log.Debugf("Building %s using %s", imageNameWithTag, d.File)
+	opts := BuildOptions{
+		Tag:       imageNameWithTag,
+		File:      d.File,
+		Context:   ".",
+		BuildArgs: d.Args,
+		Labels:    d.labels(),
+		Quiet:     d.Quiet,
+		Pull:      pull,
+		Platform:  d.platform,
+	}
+	opts.Labels[HashLabel] = hash
+	d.buildKit(&opts)
+
+	if d.NoContext {
+		stdinFile, err := os.Open(d.File)
+		if err != nil {
+			return err
 		}
-	}()
+		defer stdinFile.Close()
 
-	ioutil.WriteFile(tempfile.Name(), []byte(content), 0600)
+		opts.Stdin = stdinFile
+	} else if err := d.contextIgnore(&opts); err != nil {
+		return err
+	}
 
-	return d.exec("build", "-t", tag, "-f", tempfile.Name(), ".")
+	return d.runtime.Build(opts)
 }
 
 func (d *Dapperfile) readEnv(tag string) error {
-	var envList []string
-
-	args := []string{"inspect", "-f", "{{json .ContainerConfig.Env}}", tag}
-
-	cmd := exec.Command(d.docker, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Errorf("Failed to run docker %v: %v", args, err)
-		return err
-	}
+	d.env = map[string]string{}
 
-	if err := json.Unmarshal(output, &envList); err != nil {
+	image, err := d.runtime.Inspect(tag)
+	if err != nil && d.isDryRun() {
+		log.Warnf("Image %s is not built yet, using default settings: %v", tag, err)
+		image = &ImageInfo{}
+	} else if err != nil {
+		log.Errorf("Failed to inspect %s: %v", tag, err)
 		return err
 	}
 
-	d.env = map[string]string{}
-
-	for _, item := range envList {
+	for _, item := range image.Env {
 		parts := strings.SplitN(item, "=", 2)
 		k, v := parts[0], parts[1]
 		log.Debugf("Reading Env: %s=%s", k, v)
 		d.env[k] = v
 	}
 
+	if d.task != nil {
+		d.env = d.env.apply(d.task)
+	}
+
 	log.Debugf("Source: %s", d.env.Source())
 	log.Debugf("Cp: %s", d.env.Cp())
 	log.Debugf("Socket: %t", d.env.Socket())
@@ -510,81 +717,22 @@ func (d *Dapperfile) readEnv(tag string) error {
 }
 
 func (d *Dapperfile) ImageName() string {
-	cwd, err := os.Getwd()
-	if err == nil {
-		cwd = filepath.Base(cwd)
-	} else {
-		cwd = "dapper-unknown"
-	}
-
+	name := Project()
 	if d.Variant != "" {
-		cwd = fmt.Sprintf("%s-%s", cwd, d.Variant)
+		name = fmt.Sprintf("%s-%s", name, d.Variant)
 	}
-
-	// repository name must be lowercase
-	cwd = strings.ToLower(cwd)
-	// repository must not include @ (e.g. Jenkins workspace)
-	// re-using re definition as safeguard
-	cwd = re.ReplaceAllLiteralString(cwd, "-")
-
-	return cwd
-}
-
-func (d *Dapperfile) Tag() string {
-	output, _ := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
-	tag := strings.TrimSpace(string(output))
-	if tag == "" {
-		tag = randString()
+	if d.platform != "" {
+		name = fmt.Sprintf("%s-%s", name, platformDir(d.platform))
 	}
-	tag = re.ReplaceAllLiteralString(tag, "-")
 
-	return tag
+	// re-using re definition as safeguard
+	return re.ReplaceAllLiteralString(strings.ToLower(name), "-")
 }
 
 func (d *Dapperfile) ImageNameWithTag() string {
 	return fmt.Sprintf("%s:%s", d.ImageName(), d.Tag())
 }
 
-func (d *Dapperfile) run(args ...string) error {
-	return d.exec(append([]string{"run"}, args...)...)
-}
-
-func (d *Dapperfile) exec(args ...string) error {
-	log.Debugf("Running %s %v", d.docker, args)
-	cmd := exec.Command(d.docker, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	err := cmd.Run()
-	if err != nil {
-		log.Debugf("Failed running %s %v: %v", d.docker, args, err)
-	}
-	return err
-}
-
-func (d *Dapperfile) execWithStdin(stdin *os.File, args ...string) error {
-	log.Debugf("Running %s %v", d.docker, args)
-	cmd := exec.Command(d.docker, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = stdin
-	err := cmd.Run()
-	if err != nil {
-		log.Debugf("Failed running %s %v: %v", d.docker, args, err)
-	}
-	return err
-}
-
-func (d *Dapperfile) runExec(args ...string) error {
-	log.Debugf("Exec %s run %v", d.docker, args)
-	return syscall.Exec(d.docker, append([]string{"docker", "run"}, args...), os.Environ())
-}
-
-func (d *Dapperfile) execWithOutput(args ...string) ([]byte, error) {
-	cmd := exec.Command(d.docker, args...)
-	return cmd.CombinedOutput()
-}
-
 func (d *Dapperfile) IsBind() bool {
 	return d.env.Mode(d.Mode) == "bind"
 }
@@ -0,0 +1,224 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Labels of the images and containers dapper creates.
+const (
+	ProjectLabel    = "dapper.project"
+	VariantLabel    = "dapper.variant"
+	BranchLabel     = "dapper.branch"
+	DapperfileLabel = "dapper.dapperfile"
+	CreatedLabel    = "dapper.created"
+)
+
+// GCOptions are the retention policies of GC, a resource is removed if
+// any of them selects it.
+type GCOptions struct {
+	// OlderThan selects resources created before this duration.
+	OlderThan time.Duration
+	// KeepLast selects all but the newest KeepLast images and containers
+	// of each project and variant.
+	KeepLast int
+	// MergedBranches selects the images and containers of the current
+	// project built from branches merged into Base. The base, the current
+	// and the default branch are never selected.
+	MergedBranches bool
+	// Base is the branch MergedBranches compares with, HEAD if empty.
+	Base string
+	// DryRun only lists the selected resources.
+	DryRun bool
+}
+
+// Project returns the name of the project in the current directory, the
+// build image is named after it.
+func Project() string {
+	cwd, err := os.Getwd()
+	if err == nil {
+		cwd = filepath.Base(cwd)
+	} else {
+		cwd = "dapper-unknown"
+	}
+
+	// repository name must be lowercase and must not include @ (e.g.
+	// Jenkins workspace)
+	return re.ReplaceAllLiteralString(strings.ToLower(cwd), "-")
+}
+
+// labels returns the labels of everything created for this Dapperfile.
+func (d *Dapperfile) labels() map[string]string {
+	return map[string]string{
+		ProjectLabel:    Project(),
+		VariantLabel:    d.Variant,
+		BranchLabel:     d.Branch(),
+		DapperfileLabel: filepath.ToSlash(d.File),
+		CreatedLabel:    time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+type gcCandidate struct {
+	kind     string
+	resource Resource
+	reason   string
+}
+
+func (c gcCandidate) name() string {
+	if len(c.resource.Names) > 0 {
+		return strings.Join(c.resource.Names, ",")
+	}
+	return c.resource.ID
+}
+
+// GC removes the images, containers and sync volumes created by dapper
+// which are selected by opts, running containers are never removed. It writes a
+// table of the removed resources to w.
+func GC(runtime Runtime, opts GCOptions, w io.Writer) error {
+	if opts.OlderThan <= 0 && opts.KeepLast <= 0 && !opts.MergedBranches {
+		return fmt.Errorf("no retention policy given, use --older-than, --keep-last or --merged-branches")
+	}
+
+	merged := map[string]bool{}
+	if opts.MergedBranches {
+		base := opts.Base
+		if base == "" {
+			base = "HEAD"
+		}
+		if git("rev-parse", "--verify", "--quiet", base) == "" {
+			return fmt.Errorf("unknown base branch %s", base)
+		}
+
+		for _, branch := range strings.Fields(git("branch", "--merged", base, "--format=%(refname:short)")) {
+			merged[branch] = true
+		}
+		for _, branch := range protectedBranches(base) {
+			delete(merged, branch)
+		}
+	}
+
+	candidates := []gcCandidate{}
+	for _, kind := range []string{"container", "image", "volume"} {
+		label := ProjectLabel
+		if kind == "volume" {
+			// cache volumes are removed by `dapper cache prune`
+			label = SyncLabel
+		}
+
+		resources, err := runtime.List(kind, label)
+		if err != nil {
+			return fmt.Errorf("failed to list %ss: %v", kind, err)
+		}
+		candidates = append(candidates, selectGC(kind, resources, opts, merged)...)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tPROJECT\tBRANCH\tCREATED\tREASON")
+
+	var failed error
+	for _, c := range candidates {
+		labels := c.resource.Labels
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.kind, c.name(), labels[ProjectLabel], labels[BranchLabel],
+			c.resource.Created.Local().Format("2006-01-02 15:04"), c.reason)
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := removeResource(runtime, c); err != nil {
+			log.Errorf("Failed to remove %s %s: %v", c.kind, c.name(), err)
+			failed = err
+		}
+	}
+
+	tw.Flush()
+	return failed
+}
+
+// protectedBranches returns the branches whose images are kept by
+// MergedBranches: base, the current branch and the default branch, taken
+// from origin/HEAD or else main and master.
+func protectedBranches(base string) []string {
+	branches := []string{
+		base,
+		git("rev-parse", "--abbrev-ref", "HEAD"),
+		git("rev-parse", "--abbrev-ref", base),
+	}
+	if remote := git("symbolic-ref", "--short", "refs/remotes/origin/HEAD"); remote != "" {
+		branches = append(branches, strings.TrimPrefix(remote, "origin/"))
+	} else {
+		branches = append(branches, "main", "master")
+	}
+	return branches
+}
+
+// selectGC returns the resources selected by opts, newest first.
+func selectGC(kind string, resources []Resource, opts GCOptions, merged map[string]bool) []gcCandidate {
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Created.After(resources[j].Created)
+	})
+
+	project := Project()
+	seen := map[string]int{}
+	candidates := []gcCandidate{}
+
+	for _, r := range resources {
+		key := r.Labels[ProjectLabel] + "/" + r.Labels[VariantLabel]
+		seen[key]++
+
+		if r.Running {
+			continue
+		}
+
+		reason := ""
+		switch {
+		case opts.KeepLast > 0 && seen[key] > opts.KeepLast:
+			reason = fmt.Sprintf("more than %d", opts.KeepLast)
+		case opts.OlderThan > 0 && time.Since(r.Created) > opts.OlderThan:
+			reason = fmt.Sprintf("older than %s", opts.OlderThan)
+		case r.Labels[ProjectLabel] == project && merged[r.Labels[BranchLabel]]:
+			reason = "branch " + r.Labels[BranchLabel] + " merged"
+		default:
+			continue
+		}
+
+		candidates = append(candidates, gcCandidate{kind: kind, resource: r, reason: reason})
+	}
+
+	return candidates
+}
+
+func removeResource(runtime Runtime, c gcCandidate) error {
+	switch c.kind {
+	case "container":
+		return runtime.Rm(c.resource.ID)
+	case "volume":
+		if err := runtime.RemoveVolume(c.resource.ID); err != nil {
+			return err
+		}
+		// the next sync copies all files into a new volume
+		if manifestFile, err := syncManifestFile(c.resource.ID); err == nil {
+			os.Remove(manifestFile)
+		}
+		return nil
+	}
+
+	// remove the tags, removing the id fails for images with several
+	if len(c.resource.Names) == 0 {
+		return runtime.RemoveImage(c.resource.ID)
+	}
+	for _, name := range c.resource.Names {
+		if err := runtime.RemoveImage(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
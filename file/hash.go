@@ -0,0 +1,138 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HashLabel is the image label holding the content hash of the build.
+const HashLabel = "dapper.hash"
+
+// ContentHash returns a hash over everything the build image depends on:
+// the Dapperfile, the resolved build args, the host architecture, the
+// context files used by COPY and ADD and those selected with HashFiles.
+func (d *Dapperfile) ContentHash() (string, error) {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "arch %s\n", d.hostArch)
+
+	args := append([]string{}, d.Args...)
+	sort.Strings(args)
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %s\n", arg)
+	}
+
+	files, err := d.hashFiles()
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range append([]string{d.File}, files...) {
+		if err := hashFile(h, name); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles expands the HashFiles patterns and the context sources of
+// COPY and ADD, directories are included recursively. Files excluded from
+// the context are skipped for the sources.
+func (d *Dapperfile) hashFiles() ([]string, error) {
+	seen := map[string]bool{}
+	files := []string{}
+
+	for _, pattern := range d.HashFiles {
+		if err := globFiles(pattern, nil, seen, &files); err != nil {
+			return nil, err
+		}
+	}
+
+	if !d.NoContext && d.dockerfile != nil {
+		ignore, err := d.IgnorePatterns()
+		if err != nil {
+			return nil, err
+		}
+		m, err := newIgnoreMatcher(ignore)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, src := range d.dockerfile.ContextSources() {
+			if strings.Contains(src, "$") {
+				// depends on build args, hash the whole context
+				src = "."
+			}
+			src = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(src)), "/")
+			if src == "" {
+				src = "."
+			}
+			if err := globFiles(src, m, seen, &files); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// globFiles adds the regular files matching pattern or below a matching
+// directory to files, unless ignored by m.
+func globFiles(pattern string, m *ignoreMatcher, seen map[string]bool, files *[]string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		err := filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel := filepath.ToSlash(filepath.Clean(p))
+			if rel != "." && m.Ignored(rel) {
+				if info.IsDir() && m.SkipDir(rel) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.Mode().IsRegular() && !seen[p] {
+				seen[p] = true
+				*files = append(*files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "file %s %d\n", filepath.ToSlash(name), info.Size())
+	_, err = io.Copy(w, f)
+	return err
+}
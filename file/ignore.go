@@ -0,0 +1,281 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IgnoreFile lists the context files which are not sent to the engine, it
+// uses the same syntax as .dockerignore.
+const IgnoreFile = ".dapperignore"
+
+type ignoreRule struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// ignoreMatcher implements the matching rules of .dockerignore: a pattern
+// excludes a path and everything below it, patterns starting with ! include
+// paths again and the last matching pattern wins.
+type ignoreMatcher struct {
+	rules      []ignoreRule
+	exceptions bool
+	// keep are paths which are never excluded.
+	keep []string
+	// base is the walked directory relative to the context root, the
+	// patterns match paths relative to the root.
+	base string
+}
+
+func newIgnoreMatcher(patterns []string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+			m.exceptions = true
+		}
+
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/")
+		if pattern == "." || pattern == "" {
+			continue
+		}
+
+		re, err := compileIgnorePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", pattern, err)
+		}
+		m.rules = append(m.rules, ignoreRule{re: re, negate: negate})
+	}
+	return m, nil
+}
+
+// below returns m for walking the directory dir of the context.
+func (m *ignoreMatcher) below(dir string) *ignoreMatcher {
+	if m == nil {
+		return nil
+	}
+
+	if wd, err := os.Getwd(); err == nil && filepath.IsAbs(dir) {
+		if rel, err := filepath.Rel(wd, dir); err == nil {
+			dir = rel
+		}
+	}
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		// outside of the context no pattern matches a parent
+		return m
+	}
+
+	below := *m
+	below.base = dir
+	return &below
+}
+
+// Ignored reports whether the slash separated path rel is excluded.
+func (m *ignoreMatcher) Ignored(rel string) bool {
+	if m == nil {
+		return false
+	}
+	return m.ignored(path.Join(m.base, rel))
+}
+
+func (m *ignoreMatcher) ignored(rel string) bool {
+	for _, keep := range m.keep {
+		if rel == keep {
+			return false
+		}
+	}
+
+	parents := strings.Split(rel, "/")
+	ignored := false
+	for _, rule := range m.rules {
+		for i := range parents {
+			if rule.re.MatchString(strings.Join(parents[:i+1], "/")) {
+				ignored = !rule.negate
+				break
+			}
+		}
+	}
+	return ignored
+}
+
+// SkipDir reports whether nothing below the ignored directory rel can be
+// included again.
+func (m *ignoreMatcher) SkipDir(rel string) bool {
+	rel = path.Join(m.base, rel)
+	for _, keep := range m.keep {
+		if strings.HasPrefix(keep, rel+"/") {
+			return false
+		}
+	}
+	return m.ignored(rel) && !m.exceptions
+}
+
+// compileIgnorePattern translates a pattern to a regexp, * and ? do not
+// match /, ** matches any number of directories.
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	buf := &strings.Builder{}
+	buf.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// readIgnoreFile returns the patterns of name, a missing file has none.
+// With gitignore the patterns are translated from .gitignore syntax.
+func readIgnoreFile(name string, gitignore bool) ([]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if gitignore {
+			line = fromGitignore(line)
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// fromGitignore translates a .gitignore pattern: patterns without a slash
+// match in every directory, a leading slash anchors them to the root.
+func fromGitignore(pattern string) string {
+	negate := ""
+	if strings.HasPrefix(pattern, "!") {
+		negate = "!"
+		pattern = pattern[1:]
+	}
+
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return negate + strings.TrimPrefix(pattern, "/")
+}
+
+// IgnorePatterns returns the patterns of .dockerignore, of .gitignore with
+// GitIgnore and of .dapperignore in the context directory. Later files can
+// include files of earlier ones again.
+func (d *Dapperfile) IgnorePatterns() ([]string, error) {
+	patterns, err := readIgnoreFile(d.dockerIgnoreFile(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	own, err := d.dapperIgnorePatterns()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(patterns, own...), nil
+}
+
+// dockerIgnoreFile returns the ignore file docker uses for the Dockerfile,
+// like BuildKit "Dockerfile.dapper.dockerignore" takes precedence over
+// .dockerignore.
+func (d *Dapperfile) dockerIgnoreFile() string {
+	if _, err := os.Stat(d.File + ".dockerignore"); err == nil {
+		return d.File + ".dockerignore"
+	}
+	return ".dockerignore"
+}
+
+// dapperIgnorePatterns returns the patterns docker does not know about,
+// those of .gitignore with GitIgnore and of .dapperignore.
+func (d *Dapperfile) dapperIgnorePatterns() ([]string, error) {
+	patterns, err := readIgnoreFile(IgnoreFile, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.GitIgnore {
+		git, err := readIgnoreFile(".gitignore", true)
+		if err != nil {
+			return nil, err
+		}
+		// .dapperignore comes last so it can include files again
+		patterns = append(git, patterns...)
+	}
+
+	return patterns, nil
+}
+
+// contextIgnore sets the ignore patterns of the build context. Without
+// .dapperignore and .gitignore the engine reads .dockerignore itself and
+// the context is sent as usual. A Dockerfile outside of the context can
+// not be part of the filtered context, so it is sent unfiltered then.
+func (d *Dapperfile) contextIgnore(opts *BuildOptions) error {
+	own, err := d.dapperIgnorePatterns()
+	if err != nil || len(own) == 0 {
+		return err
+	}
+
+	context, err := filepath.Abs(buildContext(*opts))
+	if err != nil {
+		return err
+	}
+	file, err := filepath.Abs(opts.File)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(context, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		log.Warnf("%s is outside of the build context, the context is sent without applying %s and .gitignore", opts.File, IgnoreFile)
+		return nil
+	}
+
+	opts.File = rel
+	opts.Ignore, err = d.IgnorePatterns()
+	return err
+}
@@ -0,0 +1,56 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".dockerignore": "bin\n",
+		".gitignore":    "*.o\n",
+		IgnoreFile:      "!bin/keep\n",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	d := &Dapperfile{File: "Dockerfile.dapper", GitIgnore: true}
+	patterns, err := d.IgnorePatterns()
+	if err != nil {
+		t.Fatalf("IgnorePatterns: %v", err)
+	}
+	if want := []string{"bin", "**/*.o", "!bin/keep"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("patterns = %v, want %v", patterns, want)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "Dockerfile.dapper.dockerignore"), []byte("dist\n"), 0644)
+	if patterns, _ := d.IgnorePatterns(); patterns[0] != "dist" {
+		t.Errorf("patterns = %v, want those of Dockerfile.dapper.dockerignore first", patterns)
+	}
+}
+
+func TestIgnoreMatcherBelow(t *testing.T) {
+	m, err := newIgnoreMatcher([]string{"sub/vendor", "*.o"})
+	if err != nil {
+		t.Fatalf("newIgnoreMatcher: %v", err)
+	}
+
+	sub := m.below("./sub")
+	if !sub.Ignored("vendor") || !sub.SkipDir("vendor") {
+		t.Error("sub/vendor is not ignored below sub")
+	}
+	if sub.Ignored("a.o") || !m.Ignored("a.o") {
+		t.Error("*.o matches only in the context root")
+	}
+	if m.below(".") != m || m.below("../other") != m {
+		t.Error("below returned a new matcher for the context root or a path outside")
+	}
+}
@@ -0,0 +1,59 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// MatrixResult is the outcome of the command in one build image of a
+// matrix, e.g. of one platform.
+type MatrixResult struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	// Err is ErrSkipBuild if the Dockerfile skips this build.
+	Err error
+}
+
+// PrintMatrix writes a table with the exit code and duration of each
+// build, column names the first column. The total is the wall clock time
+// of the matrix.
+func PrintMatrix(w io.Writer, column string, results []MatrixResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tEXIT\tDURATION\n", column)
+
+	var first, last time.Time
+	for _, r := range results {
+		exit := "0"
+		switch {
+		case r.Err == ErrSkipBuild:
+			exit = "skipped"
+		case r.Err != nil:
+			exit = fmt.Sprint(ExtractErrorCode(r.Err))
+		}
+
+		if first.IsZero() || r.Start.Before(first) {
+			first = r.Start
+		}
+		if end := r.Start.Add(r.Duration); end.After(last) {
+			last = end
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, exit, r.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "total\t\t%s\n", last.Sub(first).Round(time.Millisecond))
+
+	tw.Flush()
+}
+
+// matrixError returns the first failure of results, skipped builds do not
+// fail the matrix.
+func matrixError(results []MatrixResult) error {
+	for _, r := range results {
+		if r.Err != nil && r.Err != ErrSkipBuild {
+			return r.Err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// lineMux interleaves the output of several containers line by line, each
+// line is prefixed with the name of its source.
+type lineMux struct {
+	mu    sync.Mutex
+	width int
+}
+
+// writer returns a writer to w which prefixes every line with prefix.
+func (m *lineMux) writer(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		mux:    m,
+		w:      w,
+		prefix: fmt.Sprintf("%-*s | ", m.width, prefix),
+	}
+}
+
+type prefixWriter struct {
+	mux    *lineMux
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// Flush writes a trailing line without newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mux.mu.Lock()
+	defer p.mux.mu.Unlock()
+
+	_, err := p.w.Write(append([]byte(p.prefix), line...))
+	return err
+}
@@ -0,0 +1,281 @@
+package file
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Output is an entry of DAPPER_OUTPUT: a path or glob pattern in the
+// container, relative to DAPPER_SOURCE, and an optional directory on the
+// host given as "src:dest".
+type Output struct {
+	Source string
+	Dest   string
+}
+
+// CopiedFile is a file copied back from the build container.
+type CopiedFile struct {
+	// Path is the path on the host.
+	Path string
+	// Source is the path in the container.
+	Source string
+	Size   int64
+}
+
+// ParseOutput parses a DAPPER_OUTPUT entry.
+func ParseOutput(entry string) Output {
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) == 2 {
+		return Output{Source: parts[0], Dest: parts[1]}
+	}
+	return Output{Source: entry}
+}
+
+func (o Output) isGlob() bool {
+	return strings.ContainsAny(o.Source, `*?[\`)
+}
+
+// base splits the source into the directory before the first glob
+// character and the pattern below it.
+func (o Output) base() (string, string) {
+	parts := strings.Split(o.Source, "/")
+	for i, part := range parts {
+		if strings.ContainsAny(part, `*?[\`) {
+			dir := path.Join(parts[:i]...)
+			if strings.HasPrefix(o.Source, "/") {
+				dir = "/" + dir
+			}
+			return dir, path.Join(parts[i:]...)
+		}
+	}
+	return o.Source, ""
+}
+
+// copyOutput copies DAPPER_OUTPUT entries from container to the host.
+// Literal paths keep the old behavior and go to the directory of the path
+// unless a destination is given. Glob patterns are matched against the
+// files of the container, including its volumes, and only the matches are
+// written to the host. They keep their path below the directory the
+// pattern starts in.
+func (d *Dapperfile) copyOutput(container string, entries []string) []CopiedFile {
+	source := d.env.Source()
+	copied := []CopiedFile{}
+
+	for _, entry := range entries {
+		output := ParseOutput(entry)
+
+		dir, pattern := output.base()
+		containerDir := dir
+		if !strings.HasPrefix(containerDir, "/") {
+			containerDir = path.Join(source, dir)
+		}
+
+		dest := output.Dest
+		if dest == "" && output.isGlob() {
+			dest = dir
+			if strings.HasPrefix(dir, "/") || dir == "" {
+				dest = "."
+			}
+		} else if dest == "" {
+			dest = path.Dir(output.Source)
+		}
+		if d.platform != "" {
+			dest = path.Join(platformDir(d.platform), dest)
+		}
+
+		log.Infof("docker cp %s %s", path.Join(containerDir, pattern), dest)
+
+		if d.isDryRun() {
+			if pattern != "" {
+				d.runtime.CopyFrom(container, containerDir, ioutil.Discard)
+			} else {
+				d.runtime.Cp(container+":"+containerDir, dest)
+			}
+			continue
+		}
+
+		files, err := d.copyOutputEntry(container, containerDir, pattern, dest)
+		if err != nil {
+			log.Debugf("Error copying back '%s': %s", entry, err)
+			continue
+		}
+		if output.isGlob() && len(files) == 0 {
+			log.Warnf("No files in the container match %s", output.Source)
+		}
+		copied = append(copied, files...)
+	}
+
+	return copied
+}
+
+// copyOutputEntry copies containerDir, or only the paths below it which
+// match pattern, to dest.
+func (d *Dapperfile) copyOutputEntry(container, containerDir, pattern, dest string) ([]CopiedFile, error) {
+	if pattern == "" {
+		tmp, err := ioutil.TempDir(".", ".dapper-output")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := d.runtime.Cp(container+":"+containerDir, tmp); err != nil {
+			return nil, err
+		}
+		root := filepath.Join(tmp, path.Base(containerDir))
+		return moveTree(root, filepath.Join(dest, path.Base(containerDir)), containerDir)
+	}
+
+	re, err := compileIgnorePattern(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output pattern %q: %v", pattern, err)
+	}
+
+	// containerDir is streamed as tar archive and only the matches are
+	// extracted, the stream covers volumes unlike a commit of the container
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(d.runtime.CopyFrom(container, containerDir, pw))
+	}()
+	defer pr.Close()
+
+	copied := []CopiedFile{}
+	matched := map[string]bool{}
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return copied, nil
+		} else if err != nil {
+			return copied, err
+		}
+
+		rel, ok := outputRel(containerDir, hdr.Name)
+		if !ok || rel == "" || !(matchedParent(matched, rel) || re.MatchString(rel)) {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			// everything below a matching directory is copied
+			matched[rel] = true
+		}
+
+		if err := extractEntry(tr, hdr, dest, rel); err != nil {
+			return copied, err
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeSymlink {
+			copied = append(copied, CopiedFile{
+				Path:   filepath.Join(dest, filepath.FromSlash(rel)),
+				Source: path.Join(containerDir, rel),
+				Size:   hdr.Size,
+			})
+		}
+	}
+}
+
+// outputRel returns the path of the tar entry name below dir, the entries
+// of `docker cp` are prefixed with the base name of dir.
+func outputRel(dir, name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if dir == "/" {
+		return name, true
+	}
+
+	base := path.Base(dir)
+	if name == base {
+		return "", true
+	}
+	if !strings.HasPrefix(name, base+"/") {
+		return "", false
+	}
+	return name[len(base)+1:], true
+}
+
+// matchedParent reports whether a parent directory of rel matched.
+func matchedParent(matched map[string]bool, rel string) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if matched[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// moveTree moves the file or directory src to dst, existing directories
+// are merged and files overwritten like docker cp does.
+func moveTree(src, dst, containerPath string) ([]CopiedFile, error) {
+	copied := []CopiedFile{}
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		if err := os.Rename(p, target); err != nil {
+			return err
+		}
+
+		copied = append(copied, CopiedFile{
+			Path:   target,
+			Source: path.Join(containerPath, filepath.ToSlash(rel)),
+			Size:   info.Size(),
+		})
+		return nil
+	})
+
+	return copied, err
+}
+
+// PrintOutputSummary writes a table of the copied files and their sizes.
+func PrintOutputSummary(w io.Writer, files []CopiedFile) {
+	if len(files) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OUTPUT\tSIZE")
+
+	total := int64(0)
+	for _, f := range files {
+		total += f.Size
+		fmt.Fprintf(tw, "%s\t%s\n", f.Path, humanSize(f.Size))
+	}
+	fmt.Fprintf(tw, "%d files\t%s\n", len(files), humanSize(total))
+
+	tw.Flush()
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
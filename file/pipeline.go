@@ -0,0 +1,235 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TaskResult is the outcome of a single task of a pipeline.
+type TaskResult struct {
+	Task     *Task
+	Start    time.Time
+	Duration time.Duration
+	// Err is nil for successful tasks and ErrTaskNotRun for tasks which
+	// did not run because an earlier task failed.
+	Err error
+}
+
+// ErrTaskNotRun marks the tasks after a failed task.
+var ErrTaskNotRun = errors.New("not run")
+
+// Pipeline returns name and all its dependencies in the order they have to
+// run, dependencies come before the tasks depending on them.
+func Pipeline(tasks map[string]*Task, name string) ([]*Task, error) {
+	order := []*Task{}
+	state := map[string]int{}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		task, ok := tasks[strings.ToLower(name)]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("task %s depends on unknown task %s", path[len(path)-1], name)
+			}
+			return fmt.Errorf("unknown task %s", name)
+		}
+
+		switch state[task.Name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), task.Name)
+		case done:
+			return nil
+		}
+
+		state[task.Name] = visiting
+		for _, dep := range task.DependsOn {
+			if err := visit(dep, append(path, task.Name)); err != nil {
+				return err
+			}
+		}
+		state[task.Name] = done
+
+		order = append(order, task)
+		return nil
+	}
+
+	if err := visit(name, nil); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// RunPipeline runs tasks in order using a single build image and stops at
+// the first failing task, whose error is returned. args are passed to the
+// last task only. With Jobs > 1 independent tasks run in parallel.
+func (d *Dapperfile) RunPipeline(tasks []*Task, args []string) ([]TaskResult, error) {
+	if d.Jobs > 1 {
+		return d.runParallel(tasks, args)
+	}
+
+	results := []TaskResult{}
+	var failed error
+
+	for i, task := range tasks {
+		if failed != nil {
+			results = append(results, TaskResult{Task: task, Err: ErrTaskNotRun})
+			continue
+		}
+
+		taskArgs := []string(nil)
+		if i == len(tasks)-1 {
+			taskArgs = args
+		}
+
+		start := time.Now()
+		err := d.RunTask(task, taskArgs)
+		results = append(results, TaskResult{
+			Task:     task,
+			Start:    start,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+
+		if err != nil {
+			log.Errorf("Task %s failed: %v", task.Name, err)
+			failed = err
+		}
+	}
+
+	return results, failed
+}
+
+// runParallel starts every task as soon as its dependencies succeeded, at
+// most Jobs at a time. The output of each task is prefixed with its name.
+func (d *Dapperfile) runParallel(tasks []*Task, args []string) ([]TaskResult, error) {
+	if _, err := d.buildOnce(); err != nil {
+		return nil, err
+	}
+
+	mux := &lineMux{}
+	for _, task := range tasks {
+		if len(task.Name) > mux.width {
+			mux.width = len(task.Name)
+		}
+	}
+
+	results := make([]TaskResult, len(tasks))
+	for i, task := range tasks {
+		results[i] = TaskResult{Task: task, Err: ErrTaskNotRun}
+	}
+
+	succeeded := map[string]bool{}
+	started := map[int]bool{}
+	finished := make(chan int)
+	running := 0
+	var failed error
+
+	ready := func(task *Task) bool {
+		for _, dep := range task.DependsOn {
+			if !succeeded[strings.ToLower(dep)] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		for i, task := range tasks {
+			if failed != nil || running >= d.Jobs {
+				break
+			}
+			if started[i] || !ready(task) {
+				continue
+			}
+
+			taskArgs := []string(nil)
+			if i == len(tasks)-1 {
+				taskArgs = args
+			}
+
+			c := *d
+			stdout := mux.writer(os.Stdout, task.Name)
+			stderr := mux.writer(os.Stderr, task.Name)
+			c.stdout, c.stderr = stdout, stderr
+
+			started[i] = true
+			running++
+
+			go func(i int, task *Task) {
+				start := time.Now()
+				err := c.RunTask(task, taskArgs)
+				stdout.Flush()
+				stderr.Flush()
+
+				results[i] = TaskResult{
+					Task:     task,
+					Start:    start,
+					Duration: time.Since(start),
+					Err:      err,
+				}
+				finished <- i
+			}(i, task)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		i := <-finished
+		running--
+
+		if err := results[i].Err; err != nil {
+			log.Errorf("Task %s failed: %v", tasks[i].Name, err)
+			if failed == nil {
+				failed = err
+			}
+		} else {
+			succeeded[tasks[i].Name] = true
+		}
+	}
+
+	return results, failed
+}
+
+// PrintSummary writes a table with the status and duration of each task,
+// the total is the wall clock time of the pipeline.
+func PrintSummary(w io.Writer, results []TaskResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSTATUS\tDURATION")
+
+	var first, last time.Time
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.Err == ErrTaskNotRun:
+			status = "skipped"
+		case r.Err != nil:
+			status = fmt.Sprintf("failed (exit %d)", ExtractErrorCode(r.Err))
+		}
+
+		if r.Err != ErrTaskNotRun {
+			if first.IsZero() || r.Start.Before(first) {
+				first = r.Start
+			}
+			if end := r.Start.Add(r.Duration); end.After(last) {
+				last = end
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Task.Name, status, r.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "total\t\t%s\n", last.Sub(first).Round(time.Millisecond))
+
+	tw.Flush()
+}
@@ -0,0 +1,97 @@
+package file
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BinfmtImage registers the QEMU emulators of other architectures with
+// binfmt_misc of the engine host.
+const BinfmtImage = "tonistiigi/binfmt"
+
+// platformArch returns the architecture of a platform like linux/arm64
+// or linux/arm/v7.
+func platformArch(platform string) string {
+	parts := strings.Split(platform, "/")
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// platformDir returns the directory of the outputs of platform, e.g.
+// linux_arm64 like the local exporter of buildx.
+func platformDir(platform string) string {
+	return strings.Replace(platform, "/", "_", -1)
+}
+
+// forPlatform returns a copy of d building and running the build image
+// of platform.
+func (d *Dapperfile) forPlatform(platform string) *Dapperfile {
+	c := *d
+	c.platform = platform
+	c.hostArch = platformArch(platform)
+	c.Args = c.argsFromEnv()
+	c.tag = ""
+	c.built = ""
+	return &c
+}
+
+// RunPlatforms runs commandArgs in a build image for each of Platforms,
+// one after the other as the base images of `# FROM` are tagged per
+// platform. Platforms not native to the engine run under emulation. The
+// outputs of each platform are copied to a subdirectory named after it.
+func (d *Dapperfile) RunPlatforms(commandArgs []string) ([]MatrixResult, error) {
+	if err := d.installEmulators(); err != nil {
+		return nil, err
+	}
+
+	results := []MatrixResult{}
+	for _, platform := range d.Platforms {
+		log.Infof("Running on %s", platform)
+
+		start := time.Now()
+		err := d.forPlatform(platform).Run(commandArgs)
+		if err != nil && err != ErrSkipBuild {
+			log.Errorf("Platform %s failed: %v", platform, err)
+		}
+
+		results = append(results, MatrixResult{
+			Name:     platform,
+			Start:    start,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+
+	return results, matrixError(results)
+}
+
+// installEmulators registers the emulators for all Platforms which differ
+// from the architecture of the engine.
+func (d *Dapperfile) installEmulators() error {
+	native := d.findHostArch()
+
+	arches := []string{}
+	seen := map[string]bool{}
+	for _, platform := range d.Platforms {
+		arch := platformArch(platform)
+		if arch != native && !seen[arch] {
+			seen[arch] = true
+			arches = append(arches, arch)
+		}
+	}
+	if len(arches) == 0 {
+		return nil
+	}
+
+	log.Infof("Installing emulators for %s", strings.Join(arches, ", "))
+	return d.runtime.Run(RunOptions{
+		Image:   BinfmtImage,
+		Remove:  true,
+		RunArgs: []string{"--privileged"},
+		Command: []string{"--install", strings.Join(arches, ",")},
+	})
+}
@@ -0,0 +1,97 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// podmanCLI drives podman, which understands nearly all docker CLI
+// arguments. Only user mapping, the socket and the inspect format differ.
+type podmanCLI struct {
+	*dockerCLI
+}
+
+func newPodmanCLI() (Runtime, error) {
+	podman, err := exec.LookPath("podman")
+	if err != nil {
+		return nil, err
+	}
+	return &podmanCLI{&dockerCLI{docker: podman}}, nil
+}
+
+func (p *podmanCLI) Name() string {
+	return "podman"
+}
+
+func (p *podmanCLI) Arch() (string, error) {
+	output, err := p.output("info", "-f", "{{.Host.Arch}}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (p *podmanCLI) Run(opts RunOptions) error {
+	return p.dockerCLI.Run(p.runOptions(opts))
+}
+
+func (p *podmanCLI) Create(opts RunOptions) error {
+	return p.dockerCLI.Create(p.runOptions(opts))
+}
+
+// runOptions rewrites the docker specific parts of opts. Rootless podman
+// maps the calling user with --userns=keep-id, which also adds the user to
+// /etc/passwd, so the passwd/group bind mounts are not needed.
+func (p *podmanCLI) runOptions(opts RunOptions) RunOptions {
+	args := []string{}
+
+	if opts.Socket {
+		opts.Socket = false
+		opts.Volumes = append(opts.Volumes, fmt.Sprintf("%s:/var/run/docker.sock", podmanSocket()))
+	}
+
+	if opts.MapUser {
+		opts.MapUser = false
+		args = append(args, "--userns=keep-id")
+	}
+
+	opts.RunArgs = append(args, opts.RunArgs...)
+	return opts
+}
+
+func (p *podmanCLI) CreateVolume(name string, labels map[string]string) error {
+	// unlike docker, podman fails for existing volumes without --ignore
+	args := []string{"volume", "create", "--ignore"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	_, err := p.output(append(args, name)...)
+	return err
+}
+
+func (p *podmanCLI) Inspect(ref string) (*ImageInfo, error) {
+	// podman images carry their env in .Config.Env only
+	return p.inspect(ref, true)
+}
+
+// podmanSocket returns the path of the podman API socket on the host,
+// preferring the rootless socket of the current user.
+func podmanSocket() string {
+	for _, env := range []string{"CONTAINER_HOST", "DOCKER_HOST"} {
+		if s := os.Getenv(env); strings.HasPrefix(s, "unix://") {
+			return strings.TrimPrefix(s, "unix://")
+		}
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		socket := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+
+	return "/run/podman/podman.sock"
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyResize calls fn whenever the terminal is resized until the returned
+// stop function is called.
+func notifyResize(fn func()) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,6 @@
+package file
+
+// notifyResize is a no-op, windows has no SIGWINCH.
+func notifyResize(fn func()) func() {
+	return func() {}
+}
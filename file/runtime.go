@@ -0,0 +1,203 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRuntime is used when no runtime was configured.
+const DefaultRuntime = "docker"
+
+// Runtime is the container engine dapper uses to build and run the build
+// image. Mode logic in Dapperfile only talks to this interface, so a new
+// backend just has to implement it and register itself in runtimes.
+type Runtime interface {
+	// Name returns the name the runtime was registered with.
+	Name() string
+	// Arch returns the architecture of the engine, e.g. "amd64".
+	Arch() (string, error)
+	Build(opts BuildOptions) error
+	Run(opts RunOptions) error
+	// Create creates the container opts.Name without starting it.
+	Create(opts RunOptions) error
+	// CopyTo extracts the tar stream content into the directory dir of
+	// container.
+	CopyTo(container, dir string, content io.Reader) error
+	// Start starts the created container opts.Name and waits for it
+	// like Run.
+	Start(opts RunOptions) error
+	Inspect(ref string) (*ImageInfo, error)
+	Tag(source, target string) error
+	Push(ref string) error
+	Pull(ref string) error
+	// Cp copies src to dst, one of both is in "container:path" notation.
+	Cp(src, dst string) error
+	// CopyFrom writes the file or directory src of container as tar
+	// stream to w, like `docker cp container:src -`.
+	CopyFrom(container, src string, w io.Writer) error
+	// List returns the images, containers or volumes, kind "image",
+	// "container" or "volume", which carry label.
+	List(kind, label string) ([]Resource, error)
+	// CreateVolume creates the named volume unless it exists.
+	CreateVolume(name string, labels map[string]string) error
+	// RemoveVolume removes the named volume.
+	RemoveVolume(name string) error
+	// RemoveImage removes the image or tag ref.
+	RemoveImage(ref string) error
+	// CreateNetwork creates the user-defined bridge network name.
+	CreateNetwork(name string, labels map[string]string) error
+	// RemoveNetwork removes the network name.
+	RemoveNetwork(name string) error
+	// Exec runs command in the running container name without any
+	// output, it fails if the command exits non-zero.
+	Exec(name string, command []string) error
+	// Kill sends signal, e.g. "SIGTERM", to the container name.
+	Kill(name, signal string) error
+	// Rm force removes a container including its anonymous volumes.
+	Rm(name string) error
+}
+
+// Resource is an image or container listed by Runtime.List.
+type Resource struct {
+	ID string
+	// Names are the tags of an image or the name of a container or
+	// volume.
+	Names   []string
+	Labels  map[string]string
+	Created time.Time
+	Running bool
+}
+
+// BuildOptions describe a single image build.
+type BuildOptions struct {
+	Tag       string
+	File      string
+	Context   string
+	BuildArgs []string
+	Labels    map[string]string
+	Pull      bool
+	Quiet     bool
+	// Stdin, when set, is sent as Dockerfile without any build context.
+	Stdin io.Reader
+	// Ignore are .dockerignore patterns of context files which are not
+	// sent to the engine.
+	Ignore []string
+	// Platform builds the image for another platform, e.g. linux/arm64.
+	Platform string
+	// CacheFrom and CacheTo are BuildKit cache locations, e.g.
+	// "type=local,src=DIR".
+	CacheFrom []string
+	CacheTo   []string
+	// Secrets and SSH are passed to BuildKit as --secret and --ssh.
+	Secrets []string
+	SSH     []string
+	// Extra is passed verbatim to the runtime (e.g. `dapper --build -- ...`).
+	Extra []string
+	// Stdout and Stderr receive the build output, os.Stdout and
+	// os.Stderr if nil.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// RunOptions describe a container started from the build image.
+type RunOptions struct {
+	Name        string
+	Image       string
+	Command     []string
+	Entrypoint  string
+	Interactive bool
+	TTY         bool
+	Remove      bool
+	// Socket bind mounts the engine socket of the host into the container.
+	Socket bool
+	// MapUser runs the container with the UID/GID of the dapper process.
+	MapUser bool
+	// Platform selects the image of another platform, which runs under
+	// emulation.
+	Platform string
+	Labels   map[string]string
+	Env      []string
+	Volumes  []string
+	// RunArgs are raw arguments from DAPPER_RUN_ARGS.
+	RunArgs []string
+	// Detach starts the container in the background, Run returns once
+	// it is started.
+	Detach bool
+	// Network connects the container to a user-defined network under
+	// its name and NetworkAliases.
+	Network        string
+	NetworkAliases []string
+	// Replace hands the terminal over to the container, the dapper
+	// process is replaced if the runtime supports it.
+	Replace bool
+	// Stdout and Stderr receive the container output, os.Stdout and
+	// os.Stderr if nil.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ImageInfo is the subset of an image inspect dapper cares about.
+type ImageInfo struct {
+	ID           string
+	Architecture string
+	// Env is the environment of the image, which is where the DAPPER_*
+	// settings are read from.
+	Env    []string
+	Labels map[string]string
+}
+
+var runtimes = map[string]func() (Runtime, error){
+	"buildx": newBuildxCLI,
+	"docker": newDockerCLI,
+	"engine": newEngine,
+	"podman": newPodmanCLI,
+}
+
+func stdout(w io.Writer) io.Writer {
+	if w == nil {
+		return os.Stdout
+	}
+	return w
+}
+
+func stderr(w io.Writer) io.Writer {
+	if w == nil {
+		return os.Stderr
+	}
+	return w
+}
+
+// NewRuntime returns the runtime registered as name.
+func NewRuntime(name string) (Runtime, error) {
+	if name == "" {
+		name = DefaultRuntime
+	}
+
+	factory, ok := runtimes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown runtime %q, valid runtimes are: %s", name, strings.Join(Runtimes(), ", "))
+	}
+	return factory()
+}
+
+// Runtimes lists the names of all registered runtimes.
+func Runtimes() []string {
+	names := []string{}
+	for name := range runtimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildContext returns the context directory of opts.
+func buildContext(opts BuildOptions) string {
+	if opts.Context == "" {
+		return "."
+	}
+	return opts.Context
+}
@@ -0,0 +1,205 @@
+package file
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultHealthTimeout is the time a service gets to become healthy.
+const DefaultHealthTimeout = 60 * time.Second
+
+// Service is a container from the services section of the dapper config,
+// which runs next to the build container:
+//
+//	[services.postgres]
+//	image = "postgres:13"
+//	env = ["POSTGRES_PASSWORD=test"]
+//	healthcheck = "pg_isready -U postgres"
+//	aliases = ["db"]
+//
+// Services are started on a network of their own for each run, the build
+// container reaches them by name and by Aliases.
+type Service struct {
+	Name    string `mapstructure:"-"`
+	Image   string
+	Env     []string
+	Aliases []string
+	// Healthcheck is a shell command run in the service container until
+	// it succeeds, the build container is started afterwards.
+	Healthcheck string
+	// HealthTimeout replaces DefaultHealthTimeout.
+	HealthTimeout time.Duration `mapstructure:"health_timeout"`
+}
+
+// ParseServices decodes the services section of the config, sorted by
+// name.
+func ParseServices(raw interface{}) ([]*Service, error) {
+	services := map[string]*Service{}
+	if raw == nil {
+		return nil, nil
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.ComposeDecodeHookFunc(mapstructure.StringToTimeDurationHookFunc(), splitFieldsHook),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           &services,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(raw); err != nil {
+		return nil, fmt.Errorf("invalid services: %v", err)
+	}
+
+	ret := []*Service{}
+	for name, service := range services {
+		service.Name = name
+		if service.Image == "" {
+			return nil, fmt.Errorf("service %s has no image", name)
+		}
+		ret = append(ret, service)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret, nil
+}
+
+// startServices creates a network for the build container of opts, starts
+// the services on it and waits until they are healthy. The returned
+// function removes the services and the network, it also runs if dapper
+// is interrupted.
+func (d *Dapperfile) startServices(opts RunOptions) (string, func(), error) {
+	if len(d.Services) == 0 {
+		return "", func() {}, nil
+	}
+
+	// a container has a single network mode, the engine would silently
+	// pick one of both
+	if network := runArgsNetwork(opts.RunArgs); network != "" {
+		return "", nil, fmt.Errorf("services need the build container on their own network, remove --network %s from DAPPER_RUN_ARGS", network)
+	}
+
+	name := opts.Name
+	network := name + "-services"
+	if err := d.runtime.CreateNetwork(network, d.labels()); err != nil {
+		return "", nil, fmt.Errorf("failed to create network %s: %v", network, err)
+	}
+
+	started := []string{}
+	stop := func() {
+		if d.Keep {
+			log.Infof("Keeping services %v and network %s", started, network)
+			return
+		}
+		for _, container := range started {
+			log.Debugf("Removing service container %s", container)
+			d.runtime.Rm(container)
+		}
+		if err := d.runtime.RemoveNetwork(network); err != nil {
+			log.Warnf("Failed to remove network %s: %v", network, err)
+		}
+	}
+	// the services are not tracked like the build container, on a signal
+	// they are removed after it
+	release := func() {}
+	if !d.isDryRun() {
+		release = onInterrupt(stop)
+	}
+	teardown := func() {
+		release()
+		stop()
+	}
+
+	for _, service := range d.Services {
+		container := fmt.Sprintf("%s-%s", name, re.ReplaceAllLiteralString(service.Name, "-"))
+		started = append(started, container)
+
+		if err := d.startService(service, container, network); err != nil {
+			teardown()
+			return "", nil, err
+		}
+	}
+
+	for i, service := range d.Services {
+		if err := d.waitForService(service, started[i]); err != nil {
+			teardown()
+			return "", nil, err
+		}
+	}
+
+	return network, teardown, nil
+}
+
+func (d *Dapperfile) startService(service *Service, container, network string) error {
+	if _, err := d.runtime.Inspect(service.Image); err != nil {
+		if err := d.runtime.Pull(service.Image); err != nil {
+			return fmt.Errorf("failed to pull image %s of service %s: %v", service.Image, service.Name, err)
+		}
+	}
+
+	log.Infof("Starting service %s (%s)", service.Name, service.Image)
+	err := d.runtime.Run(RunOptions{
+		Name:           container,
+		Image:          service.Image,
+		Env:            service.Env,
+		Labels:         d.labels(),
+		Detach:         true,
+		Network:        network,
+		NetworkAliases: append([]string{service.Name}, service.Aliases...),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start service %s: %v", service.Name, err)
+	}
+	return nil
+}
+
+// runArgsNetwork returns the network given with --network or --net in
+// DAPPER_RUN_ARGS.
+func runArgsNetwork(args []string) string {
+	for i, arg := range args {
+		for _, flag := range []string{"--network", "--net"} {
+			if arg == flag && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, flag+"=") {
+				return strings.TrimPrefix(arg, flag+"=")
+			}
+		}
+	}
+	return ""
+}
+
+// waitForService runs the healthcheck of service every second until it
+// succeeds.
+func (d *Dapperfile) waitForService(service *Service, container string) error {
+	if service.Healthcheck == "" {
+		return nil
+	}
+
+	timeout := service.HealthTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	log.Infof("Waiting for service %s to become healthy", service.Name)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := d.runtime.Exec(container, []string{"sh", "-c", service.Healthcheck})
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s is not healthy after %s: %v", service.Name, timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,177 @@
+package file
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStopTimeout is the time a container gets to exit after dapper
+// forwarded a signal to it.
+const DefaultStopTimeout = 10 * time.Second
+
+// signalNames are the signals forwarded to running containers.
+var signalNames = map[os.Signal]string{
+	os.Interrupt:    "SIGINT",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// runningContainer is a container which is stopped when dapper receives
+// a signal.
+type runningContainer struct {
+	runtime Runtime
+	timeout time.Duration
+	keep    bool
+}
+
+// containers tracks the running containers of all tasks of this process.
+var containers = struct {
+	sync.Mutex
+	once        sync.Once
+	running     map[string]runningContainer
+	done        chan struct{}
+	interrupted bool
+	// cleanups run after the containers were removed
+	cleanups    map[int]func()
+	nextCleanup int
+}{
+	running:  map[string]runningContainer{},
+	done:     make(chan struct{}, 1),
+	cleanups: map[int]func(){},
+}
+
+// track registers the container name until the returned function is
+// called. Once a signal was received that function does not return, the
+// signal handler exits dapper after the containers are removed.
+func (d *Dapperfile) track(name string) func() {
+	notifySignals()
+
+	timeout := d.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+
+	containers.Lock()
+	if containers.interrupted {
+		// do not start new containers while shutting down
+		containers.Unlock()
+		select {}
+	}
+	containers.running[name] = runningContainer{
+		runtime: d.runtime,
+		timeout: timeout,
+		keep:    d.Keep,
+	}
+	containers.Unlock()
+
+	return func() {
+		containers.Lock()
+		delete(containers.running, name)
+		interrupted := containers.interrupted
+		empty := len(containers.running) == 0
+		containers.Unlock()
+
+		if interrupted {
+			if empty {
+				select {
+				case containers.done <- struct{}{}:
+				default:
+				}
+			}
+			// the signal handler exits the process
+			select {}
+		}
+	}
+}
+
+// notifySignals installs the signal handler once, from then on dapper
+// does not exit on a signal before the cleanups ran.
+func notifySignals() {
+	containers.once.Do(func() {
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go handleSignals(ch)
+	})
+}
+
+// onInterrupt registers fn to run when dapper exits on a signal, after the
+// containers were removed, until the returned function is called. It also
+// runs on a signal before the first container is tracked.
+func onInterrupt(fn func()) func() {
+	notifySignals()
+
+	containers.Lock()
+	defer containers.Unlock()
+
+	id := containers.nextCleanup
+	containers.nextCleanup++
+	containers.cleanups[id] = fn
+
+	return func() {
+		containers.Lock()
+		delete(containers.cleanups, id)
+		containers.Unlock()
+	}
+}
+
+// handleSignals forwards the first signal to all running containers, waits
+// until they exited or the stop timeout passed, removes them and exits
+// with 128+signal. A second signal skips the wait.
+func handleSignals(ch chan os.Signal) {
+	sig := <-ch
+
+	containers.Lock()
+	containers.interrupted = true
+	cleanups := []func(){}
+	for _, fn := range containers.cleanups {
+		cleanups = append(cleanups, fn)
+	}
+	running := map[string]runningContainer{}
+	timeout := time.Duration(0)
+	for name, c := range containers.running {
+		running[name] = c
+		if c.timeout > timeout {
+			timeout = c.timeout
+		}
+	}
+	containers.Unlock()
+
+	if len(running) > 0 {
+		log.Warnf("Received %s, stopping %d container(s), waiting up to %s", sig, len(running), timeout)
+		for name, c := range running {
+			if err := c.runtime.Kill(name, signalNames[sig]); err != nil {
+				log.Debugf("Failed to send %s to %s: %v", sig, name, err)
+			}
+		}
+
+		select {
+		case <-containers.done:
+		case <-time.After(timeout):
+			log.Warnf("Containers did not stop within %s", timeout)
+		case <-ch:
+		}
+
+		for name, c := range running {
+			if c.keep {
+				log.Infof("Keeping container %s", name)
+				continue
+			}
+			log.Infof("Removing container %s", name)
+			c.runtime.Rm(name)
+		}
+	}
+
+	for _, fn := range cleanups {
+		fn()
+	}
+
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	os.Exit(code)
+}
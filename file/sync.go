@@ -0,0 +1,345 @@
+package file
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncLabel holds DAPPER_SOURCE on the volumes of sync mode.
+const SyncLabel = "dapper.sync"
+
+// syncMarker is the file in DAPPER_SOURCE holding the id of the manifest
+// the volume content belongs to.
+const syncMarker = ".dapper-sync"
+
+// syncDeleted is the file in DAPPER_SOURCE listing the files to delete,
+// separated by NUL. A list in the volume has no size limit unlike
+// arguments of the helper.
+const syncDeleted = ".dapper-sync-deleted"
+
+// syncExitResync is returned by the sync helper if the volume does not
+// match the manifest, e.g. because it was removed.
+const syncExitResync = 10
+
+// syncScript deletes the files listed in syncDeleted from the volume. If
+// the marker does not match, the volume is emptied and everything has to be
+// copied.
+const syncScript = `cd "$1" || exit 1
+if [ "$(cat ` + syncMarker + ` 2>/dev/null)" != "$2" ]; then
+	find . -mindepth 1 -maxdepth 1 -exec rm -rf {} +
+	exit 10
+fi
+if [ -f ` + syncDeleted + ` ]; then
+	xargs -0 rm -rf -- < ` + syncDeleted + ` || exit 1
+	rm -f ` + syncDeleted + `
+fi
+`
+
+// syncMu serializes syncing of tasks running in parallel.
+var syncMu sync.Mutex
+
+// syncEntry is the state of a single file of the source.
+type syncEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+// syncManifest is the state of the source last copied into the volume.
+type syncManifest struct {
+	ID    string               `json:"id"`
+	Files map[string]syncEntry `json:"files"`
+}
+
+// SyncVolume returns the volume holding DAPPER_SOURCE in sync mode, there
+// is one per project and branch.
+func (d *Dapperfile) SyncVolume() string {
+	branch := d.Branch()
+	if branch == "" {
+		branch = d.Commit()
+	}
+	if branch == "" {
+		branch = "none"
+	}
+	return strings.ToLower(fmt.Sprintf("dapper-sync-%s-%s", d.ImageName(), re.ReplaceAllLiteralString(branch, "-")))
+}
+
+// createSyncVolume creates the labeled volume of SyncVolume, so it can be
+// removed by GC once the branch is gone.
+func (d *Dapperfile) createSyncVolume() error {
+	labels := d.labels()
+	labels[SyncLabel] = path.Clean(d.env.Source())
+	if err := d.runtime.CreateVolume(d.SyncVolume(), labels); err != nil {
+		return fmt.Errorf("failed to create sync volume %s: %v", d.SyncVolume(), err)
+	}
+	return nil
+}
+
+func (d *Dapperfile) IsSync() bool {
+	return d.env.Mode(d.Mode) == "sync"
+}
+
+// syncSource brings the volume of the created container opts.Name up to
+// date with DAPPER_CP, only files which changed since the last run are
+// copied.
+func (d *Dapperfile) syncSource(opts RunOptions) error {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	source := path.Clean(d.env.Source())
+	manifestFile, err := syncManifestFile(d.SyncVolume())
+	if err != nil {
+		return err
+	}
+
+	previous := loadSyncManifest(manifestFile)
+
+	ignore, err := d.IgnorePatterns()
+	if err != nil {
+		return err
+	}
+	m, err := newIgnoreMatcher(ignore)
+	if err != nil {
+		return err
+	}
+	m = m.below(d.env.Cp())
+
+	current, err := scanSource(d.env.Cp(), m, previous)
+	if err != nil {
+		return err
+	}
+	current.ID = previous.ID
+
+	changed, deleted := diffManifests(previous, current)
+
+	if len(deleted) > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			list := strings.Join(deleted, "\x00") + "\x00"
+			pw.CloseWithError(tarFile(pw, syncDeleted, []byte(list)))
+		}()
+		err := d.runtime.CopyTo(opts.Name, source, pr)
+		pr.Close()
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %v", d.SyncVolume(), err)
+		}
+	}
+
+	err = d.runtime.Run(RunOptions{
+		Name:       opts.Name + "-sync",
+		Image:      opts.Image,
+		Entrypoint: "sh",
+		Command:    []string{"-c", syncScript, "sh", source, previous.ID},
+		Remove:     true,
+		Labels:     d.labels(),
+		Volumes:    []string{d.SyncVolume() + ":" + source},
+		Stdout:     d.stdout,
+		Stderr:     d.stderr,
+	})
+	if err != nil && ExtractErrorCode(err) == syncExitResync {
+		log.Infof("Volume %s is out of date, copying all files", d.SyncVolume())
+		current.ID = randString()
+		changed, deleted = diffManifests(&syncManifest{}, current)
+	} else if err != nil {
+		return fmt.Errorf("failed to sync %s: %v", d.SyncVolume(), err)
+	}
+
+	log.Infof("Syncing %d changed and %d deleted files to %s", len(changed), len(deleted), d.SyncVolume())
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(tarSyncFiles(pw, d.env.Cp(), path.Base(source), changed, current.ID))
+	}()
+
+	if err := d.runtime.CopyTo(opts.Name, path.Dir(source), pr); err != nil {
+		return err
+	}
+
+	if d.isDryRun() {
+		return nil
+	}
+	return saveSyncManifest(manifestFile, current)
+}
+
+// scanSource builds the manifest of dir, files whose size and mtime did
+// not change keep the hash of previous.
+func scanSource(dir string, ignore *ignoreMatcher, previous *syncManifest) (*syncManifest, error) {
+	manifest := &syncManifest{Files: map[string]syncEntry{}}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." || rel == syncMarker {
+			return nil
+		}
+
+		if ignore.Ignored(rel) {
+			if info.IsDir() && ignore.SkipDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entry := syncEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Mode:    info.Mode(),
+		}
+
+		switch {
+		case info.IsDir():
+			entry.Size = 0
+			entry.ModTime = time.Time{}
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if old, ok := previous.Files[rel]; ok && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+				entry.Hash = old.Hash
+			} else if entry.Hash, err = fileHash(p); err != nil {
+				return err
+			}
+		default:
+			// sockets, devices and pipes can not be copied
+			return nil
+		}
+
+		manifest.Files[rel] = entry
+		return nil
+	})
+
+	return manifest, err
+}
+
+// diffManifests returns the files of current which are new or changed and
+// the files of previous which do not exist anymore, both sorted.
+func diffManifests(previous, current *syncManifest) ([]string, []string) {
+	changed := []string{}
+	for name, entry := range current.Files {
+		old, ok := previous.Files[name]
+		if !ok || old.Mode != entry.Mode || old.Hash != entry.Hash || old.Link != entry.Link {
+			changed = append(changed, name)
+		}
+	}
+
+	deleted := []string{}
+	for name := range previous.Files {
+		if _, ok := current.Files[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+
+	sort.Strings(changed)
+	sort.Strings(deleted)
+	return changed, deleted
+}
+
+// tarSyncFiles writes the files of dir as tar stream prefixed with prefix,
+// followed by the marker with id.
+func tarSyncFiles(w io.Writer, dir, prefix string, files []string, id string) error {
+	tw := tar.NewWriter(w)
+
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if err := addTarEntry(tw, p, path.Join(prefix, name), info); err != nil {
+			return err
+		}
+	}
+
+	hdr := &tar.Header{
+		Name:    path.Join(prefix, syncMarker),
+		Mode:    0644,
+		Size:    int64(len(id)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw, id); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func fileHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func syncManifestFile(volume string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dapper", "sync", volume+".json"), nil
+}
+
+// loadSyncManifest returns the manifest saved in name, a missing or broken
+// manifest is empty and makes the next sync copy everything.
+func loadSyncManifest(name string) *syncManifest {
+	manifest := &syncManifest{}
+
+	content, err := ioutil.ReadFile(name)
+	if err == nil {
+		err = json.Unmarshal(content, manifest)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Ignoring sync manifest %s: %v", name, err)
+	}
+
+	if err != nil || manifest.ID == "" || manifest.Files == nil {
+		return &syncManifest{ID: randString(), Files: map[string]syncEntry{}}
+	}
+	return manifest
+}
+
+func saveSyncManifest(name string, manifest *syncManifest) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, content, 0644)
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TagStrategies are the valid values of Dapperfile.TagStrategy.
+var TagStrategies = []string{"branch", "commit", "content-hash", "fixed"}
+
+// Tag returns the tag of the build image according to TagStrategy. The
+// branch strategy falls back to the commit in detached checkouts, both
+// fall back to the content hash outside of git.
+func (d *Dapperfile) Tag() string {
+	if d.tag != "" {
+		return d.tag
+	}
+
+	tag := ""
+	switch d.TagStrategy {
+	case "", "branch":
+		tag = d.Branch()
+		if tag == "" {
+			tag = d.Commit()
+		}
+	case "commit":
+		tag = d.Commit()
+	case "fixed":
+		tag = d.FixedTag
+		if tag == "" {
+			tag = "latest"
+		}
+	}
+
+	if tag == "" {
+		tag = d.Hash()
+	}
+	if tag == "" {
+		tag = randString()
+	}
+
+	d.tag = re.ReplaceAllLiteralString(tag, "-")
+	return d.tag
+}
+
+// Branch returns the current git branch, it is empty outside of git and
+// in detached checkouts.
+func (d *Dapperfile) Branch() string {
+	branch := git("rev-parse", "--abbrev-ref", "HEAD")
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
+}
+
+// Commit returns the short hash of the current git commit.
+func (d *Dapperfile) Commit() string {
+	return git("rev-parse", "--short", "HEAD")
+}
+
+// Hash returns the shortened ContentHash.
+func (d *Dapperfile) Hash() string {
+	hash, err := d.ContentHash()
+	if err != nil {
+		log.Debugf("Failed to compute content hash: %v", err)
+		return ""
+	}
+	return hash[:12]
+}
+
+// Arch returns the architecture of the container engine.
+func (d *Dapperfile) Arch() string {
+	return d.hostArch
+}
+
+func git(args ...string) string {
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		log.Debugf("Failed running git %v: %v", args, err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// ValidateTagStrategy returns an error for unknown tag strategies.
+func ValidateTagStrategy(strategy string) error {
+	if strategy == "" {
+		return nil
+	}
+	for _, s := range TagStrategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown tag strategy %q, valid strategies are: %s", strategy, strings.Join(TagStrategies, ", "))
+}
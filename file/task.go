@@ -0,0 +1,254 @@
+package file
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// Task is a named command from the tasks section of the dapper config:
+//
+//	[tasks.test]
+//	command = "make test"
+//	env = ["CGO_ENABLED=0"]
+//	output = ["build/reports"]
+//
+// Env, Volumes and RunArgs are added to the DAPPER_ENV, DAPPER_VOLUMES and
+// DAPPER_RUN_ARGS of the image, Output and OutputOnFailure replace
+// DAPPER_OUTPUT and DAPPER_OUTPUT_ON_FAILURE and Mode replaces the mode
+// given on the command line. DependsOn lists tasks that have to run first,
+// see Pipeline. Tasks without command just group their dependencies.
+type Task struct {
+	Name        string `mapstructure:"-"`
+	Description string
+	Command     []string
+	Env         []string
+	Volumes     []string
+	RunArgs     []string `mapstructure:"run_args"`
+	Mode        string
+	Output      []string
+	// OutputOnFailure replaces DAPPER_OUTPUT_ON_FAILURE.
+	OutputOnFailure []string `mapstructure:"output_on_failure"`
+	// Timeout and IdleTimeout replace --timeout and --idle-timeout.
+	Timeout     time.Duration
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// DependsOn are tasks which have to run successfully before.
+	DependsOn []string `mapstructure:"depends_on"`
+}
+
+// ParseTasks decodes the tasks section of the config, lists may be given
+// as space separated strings like the DAPPER_* variables. A command given
+// as string is split into words like the shell does, without expanding
+// anything.
+func ParseTasks(raw interface{}) (map[string]*Task, error) {
+	tasks := map[string]*Task{}
+	if raw == nil {
+		return tasks, nil
+	}
+
+	raw, err := splitCommands(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.ComposeDecodeHookFunc(mapstructure.StringToTimeDurationHookFunc(), splitFieldsHook),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           &tasks,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(raw); err != nil {
+		return nil, fmt.Errorf("invalid tasks: %v", err)
+	}
+
+	for name, task := range tasks {
+		task.Name = name
+		if len(task.Command) == 0 && len(task.DependsOn) == 0 {
+			return nil, fmt.Errorf("task %s has neither command nor depends_on", name)
+		}
+	}
+
+	return tasks, nil
+}
+
+// SortedTasks returns the tasks ordered by name.
+func SortedTasks(tasks map[string]*Task) []*Task {
+	ret := []*Task{}
+	for _, task := range tasks {
+		ret = append(ret, task)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// splitCommands returns a copy of the raw tasks with string commands
+// replaced by their shell words.
+func splitCommands(raw interface{}) (interface{}, error) {
+	rawTasks, ok := raw.(map[string]interface{})
+	if !ok {
+		return raw, nil
+	}
+
+	ret := map[string]interface{}{}
+	for name, rawTask := range rawTasks {
+		ret[name] = rawTask
+
+		task, ok := rawTask.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		command, ok := task["command"].(string)
+		if !ok {
+			continue
+		}
+
+		words, err := shellWords(command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command of task %s: %v", name, err)
+		}
+
+		copied := map[string]interface{}{}
+		for k, v := range task {
+			copied[k] = v
+		}
+		copied["command"] = words
+		ret[name] = copied
+	}
+	return ret, nil
+}
+
+// shellWords splits s at whitespace, quotes and backslashes work like in
+// the shell. Variables, globs and operators like && are not interpreted,
+// use ["sh", "-c", "..."] for them.
+func shellWords(s string) ([]string, error) {
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			// in double quotes a backslash only escapes some characters
+			if quote == '"' && !strings.ContainsRune("\"$`\\\n", r) {
+				word.WriteRune('\\')
+			}
+			// a backslash before a newline continues the line
+			if r != '\n' {
+				word.WriteRune(r)
+				inWord = true
+			}
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if escaped {
+		word.WriteRune('\\')
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func splitFieldsHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to.Kind() == reflect.Slice {
+		return strings.Fields(data.(string)), nil
+	}
+	return data, nil
+}
+
+// apply layers the task settings on top of the image context.
+func (c Context) apply(task *Task) Context {
+	ret := Context{}
+	for k, v := range c {
+		ret[k] = v
+	}
+
+	add := func(key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		ret[key] = strings.TrimSpace(ret[key] + " " + strings.Join(values, " "))
+	}
+
+	add("DAPPER_ENV", task.Env)
+	add("DAPPER_VOLUMES", task.Volumes)
+	add("DAPPER_RUN_ARGS", task.RunArgs)
+
+	if task.Output != nil {
+		ret["DAPPER_OUTPUT"] = strings.Join(task.Output, " ")
+	}
+	if task.OutputOnFailure != nil {
+		ret["DAPPER_OUTPUT_ON_FAILURE"] = strings.Join(task.OutputOnFailure, " ")
+	}
+
+	return ret
+}
+
+// RunTask runs the command of task in the build container, args are
+// appended to the command.
+func (d *Dapperfile) RunTask(task *Task, args []string) error {
+	if len(task.Command) == 0 {
+		log.Debugf("Task %s only groups its dependencies", task.Name)
+		return nil
+	}
+
+	log.Infof("Running task %s", task.Name)
+
+	mode, timeout, idleTimeout := d.Mode, d.Timeout, d.IdleTimeout
+	d.task = task
+	defer func() {
+		d.Mode, d.Timeout, d.IdleTimeout = mode, timeout, idleTimeout
+		d.task = nil
+	}()
+
+	if task.Mode != "" {
+		d.Mode = task.Mode
+	}
+	if task.Timeout > 0 {
+		d.Timeout = task.Timeout
+	}
+	if task.IdleTimeout > 0 {
+		d.IdleTimeout = task.IdleTimeout
+	}
+
+	command := append(append([]string{}, task.Command...), args...)
+	return d.Run(command)
+}
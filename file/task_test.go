@@ -0,0 +1,72 @@
+package file
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"make test", []string{"make", "test"}},
+		{"  go  test\t./... ", []string{"go", "test", "./..."}},
+		{`sh -c 'make && make test'`, []string{"sh", "-c", "make && make test"}},
+		{`echo "a \"b\" \$HOME \n" ''`, []string{"echo", `a "b" $HOME \n`, ""}},
+		{`echo a\ b 'c\d'`, []string{"echo", "a b", `c\d`}},
+		{"make \\\n  test", []string{"make", "test"}},
+		{`x"y"'z'`, []string{"xyz"}},
+	}
+
+	for _, test := range tests {
+		got, err := shellWords(test.in)
+		if err != nil {
+			t.Errorf("shellWords(%q): %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("shellWords(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{`echo "a`, `echo 'a`} {
+		if _, err := shellWords(in); err == nil {
+			t.Errorf("shellWords(%q) succeeded, want an unterminated quote", in)
+		}
+	}
+}
+
+func TestParseTasksCommand(t *testing.T) {
+	raw := map[string]interface{}{
+		"test": map[string]interface{}{
+			"command": `go test -run "TestA|TestB" ./...`,
+			"env":     "A=1 B=2",
+		},
+		"lint": map[string]interface{}{
+			"command": []interface{}{"golangci-lint", "run"},
+		},
+	}
+
+	tasks, err := ParseTasks(raw)
+	if err != nil {
+		t.Fatalf("ParseTasks: %v", err)
+	}
+	if want := []string{"go", "test", "-run", "TestA|TestB", "./..."}; !reflect.DeepEqual(tasks["test"].Command, want) {
+		t.Errorf("command = %q, want %q", tasks["test"].Command, want)
+	}
+	if want := []string{"A=1", "B=2"}; !reflect.DeepEqual(tasks["test"].Env, want) {
+		t.Errorf("env = %q, want %q", tasks["test"].Env, want)
+	}
+	if want := []string{"golangci-lint", "run"}; !reflect.DeepEqual(tasks["lint"].Command, want) {
+		t.Errorf("command = %q, want %q", tasks["lint"].Command, want)
+	}
+	if _, ok := raw["test"].(map[string]interface{})["command"].(string); !ok {
+		t.Error("ParseTasks modified the raw config")
+	}
+
+	raw["test"] = map[string]interface{}{"command": `echo "unterminated`}
+	if _, err := ParseTasks(raw); err == nil {
+		t.Error("ParseTasks accepted an unterminated quote")
+	}
+}
@@ -1,9 +1,11 @@
 package file
 
 import (
+	"errors"
 	"math/rand"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -23,30 +25,36 @@ func randString() string {
 	return string(b)
 }
 
-func toMap(str string) map[string]string {
-	kv := map[string]string{}
-
-	for _, part := range strings.Fields(str) {
-		kvs := strings.SplitN(part, "=", 2)
-		if len(kvs) != 2 {
-			continue
-		}
-		kv[kvs[0]] = kvs[1]
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
 	}
-
-	return kv
+	sort.Strings(keys)
+	return keys
 }
 
 func ExtractErrorCode(err error) int {
 	exitCode := 1
 	if err != nil {
+		var exitError *ExitError
+		if errors.As(err, &exitError) {
+			return exitError.ExitCode()
+		}
+
+		var timeoutError *TimeoutError
+		if errors.As(err, &timeoutError) {
+			return timeoutError.ExitCode()
+		}
+
 		// I guess syscall things wont work on windows
 		if runtime.GOOS == "windows" {
 			return exitCode
 		}
 
-		if exitError, ok := err.(*exec.ExitError); ok {
-			ws := exitError.Sys().(syscall.WaitStatus)
+		var execError *exec.ExitError
+		if errors.As(err, &execError) {
+			ws := execError.Sys().(syscall.WaitStatus)
 			exitCode = ws.ExitStatus()
 		}
 	}
@@ -0,0 +1,121 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VariantFiles returns the Dockerfile.<variant>.dapper files in the
+// directory of file by variant.
+func VariantFiles(file string) (map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(file), "Dockerfile.*.dapper"))
+	if err != nil {
+		return nil, err
+	}
+
+	variants := map[string]string{}
+	for _, f := range files {
+		if variant := ExtractVariantFromFilename(filepath.Base(f)); variant != "" {
+			variants[variant] = f
+		}
+	}
+	return variants, nil
+}
+
+// SelectVariants returns the files of names, or of all variants if names
+// is empty, sorted by variant.
+func SelectVariants(variants map[string]string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		for variant := range variants {
+			names = append(names, variant)
+		}
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no Dockerfile.<variant>.dapper found")
+	}
+
+	files := []string{}
+	for _, name := range names {
+		f, ok := variants[name]
+		if !ok {
+			valid := []string{}
+			for variant := range variants {
+				valid = append(valid, variant)
+			}
+			sort.Strings(valid)
+			return nil, fmt.Errorf("unknown variant %s, valid variants are: %s", name, strings.Join(valid, ", "))
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// RunVariants runs commandArgs in the build image of each variant, at most
+// jobs at a time. The images are built one after another as variants may
+// share retargeted base images, a variant whose image fails to build does
+// not run. With jobs > 1 the output is prefixed with the variant.
+func RunVariants(variants []*Dapperfile, commandArgs []string, jobs int) ([]MatrixResult, error) {
+	mux := &lineMux{}
+	for _, d := range variants {
+		if len(d.Variant) > mux.width {
+			mux.width = len(d.Variant)
+		}
+	}
+
+	results := make([]MatrixResult, len(variants))
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	for i, d := range variants {
+		i, d := i, d
+		log.Infof("Running variant %s", d.Variant)
+		start := time.Now()
+
+		result := func(err error) {
+			if err != nil && err != ErrSkipBuild {
+				log.Errorf("Variant %s failed: %v", d.Variant, err)
+			}
+			results[i] = MatrixResult{
+				Name:     d.Variant,
+				Start:    start,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+		}
+
+		if _, err := d.buildOnce(); err != nil || jobs <= 1 {
+			if err == nil {
+				err = d.Run(commandArgs)
+			}
+			result(err)
+			continue
+		}
+
+		stdout := mux.writer(os.Stdout, d.Variant)
+		stderr := mux.writer(os.Stderr, d.Variant)
+		d.stdout, d.stderr = stdout, stderr
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(d *Dapperfile) {
+			defer wg.Done()
+			err := d.Run(commandArgs)
+			stdout.Flush()
+			stderr.Flush()
+			result(err)
+			<-slots
+		}(d)
+	}
+
+	wg.Wait()
+	return results, matrixError(results)
+}
@@ -0,0 +1,185 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExitTimeout is the exit code of dapper when the build container was
+// stopped by --timeout or --idle-timeout, like coreutils timeout.
+const ExitTimeout = 124
+
+// watchdogLines is the number of output lines shown after a timeout.
+const watchdogLines = 20
+
+// TimeoutError is returned when the build container was stopped because it
+// ran too long or did not write any output for too long.
+type TimeoutError struct {
+	Idle    bool
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Idle {
+		return fmt.Sprintf("no output for %s, build container stopped", e.Timeout)
+	}
+	return fmt.Sprintf("timeout of %s exceeded, build container stopped", e.Timeout)
+}
+
+func (e *TimeoutError) ExitCode() int {
+	return ExitTimeout
+}
+
+// watchdog watches the output of a container, it calls stop when the
+// container runs longer than timeout or writes nothing for idle.
+type watchdog struct {
+	timeout time.Duration
+	idle    time.Duration
+
+	mu       sync.Mutex
+	last     time.Time
+	lines    []string
+	partial  []byte
+	timedOut *TimeoutError
+}
+
+func newWatchdog(timeout, idle time.Duration) *watchdog {
+	return &watchdog{
+		timeout: timeout,
+		idle:    idle,
+		last:    time.Now(),
+	}
+}
+
+// writer returns a writer passing everything to w.
+func (wd *watchdog) writer(w io.Writer) io.Writer {
+	return &watchdogWriter{wd: wd, w: w}
+}
+
+type watchdogWriter struct {
+	wd *watchdog
+	w  io.Writer
+}
+
+func (w *watchdogWriter) Write(p []byte) (int, error) {
+	w.wd.record(p)
+	return w.w.Write(p)
+}
+
+func (wd *watchdog) record(p []byte) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	wd.last = time.Now()
+	wd.partial = append(wd.partial, p...)
+	for {
+		i := bytes.IndexByte(wd.partial, '\n')
+		if i < 0 {
+			break
+		}
+		wd.lines = append(wd.lines, string(bytes.TrimRight(wd.partial[:i], "\r")))
+		wd.partial = wd.partial[i+1:]
+	}
+	if len(wd.lines) > watchdogLines {
+		wd.lines = wd.lines[len(wd.lines)-watchdogLines:]
+	}
+}
+
+// start watches until the returned function is called.
+func (wd *watchdog) start(stop func()) func() {
+	tick := time.Second
+	if wd.idle > 0 && wd.idle/4 < tick {
+		tick = wd.idle / 4
+	}
+
+	started := time.Now()
+	ticker := time.NewTicker(tick)
+	done := make(chan struct{})
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				wd.mu.Lock()
+				switch {
+				case wd.timeout > 0 && now.Sub(started) > wd.timeout:
+					wd.timedOut = &TimeoutError{Timeout: wd.timeout}
+				case wd.idle > 0 && now.Sub(wd.last) > wd.idle:
+					wd.timedOut = &TimeoutError{Idle: true, Timeout: wd.idle}
+				}
+				timedOut := wd.timedOut != nil
+				wd.mu.Unlock()
+
+				if timedOut {
+					stop()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// err returns the TimeoutError if the container was stopped.
+func (wd *watchdog) err() error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.timedOut == nil {
+		return nil
+	}
+	return wd.timedOut
+}
+
+// dump writes the last lines of output to w.
+func (wd *watchdog) dump(w io.Writer) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	lines := wd.lines
+	if len(wd.partial) > 0 {
+		lines = append(lines, string(wd.partial))
+	}
+
+	fmt.Fprintf(w, "--- last %d lines of output ---\n", len(lines))
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "---")
+}
+
+// watch runs fn with opts and stops the container opts.Name when it
+// exceeds Timeout or IdleTimeout, the last lines of its output are shown
+// and a TimeoutError is returned.
+func (d *Dapperfile) watch(opts RunOptions, fn func(RunOptions) error) error {
+	if d.isDryRun() || (d.Timeout <= 0 && d.IdleTimeout <= 0) {
+		return fn(opts)
+	}
+
+	wd := newWatchdog(d.Timeout, d.IdleTimeout)
+	opts.Stdout = wd.writer(stdout(opts.Stdout))
+	opts.Stderr = wd.writer(stderr(opts.Stderr))
+
+	stop := wd.start(func() {
+		log.Errorf("%v, removing %s", wd.err(), opts.Name)
+		d.runtime.Rm(opts.Name)
+	})
+	err := fn(opts)
+	stop()
+
+	if timeoutErr := wd.err(); timeoutErr != nil {
+		wd.dump(stderr(d.stderr))
+		return timeoutErr
+	}
+	return err
+}